@@ -2,18 +2,32 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"k8s.io/klog/v2"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	restconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/yaml"
 
+	"github.com/kubesphere-extensions/upgrade/pkg/config"
 	"github.com/kubesphere-extensions/upgrade/pkg/core"
+	"github.com/kubesphere-extensions/upgrade/pkg/hooks"
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
 )
 
+var configFlags = config.NewFlags()
+
 func init() {
 	fs := flag.NewFlagSet("", flag.ExitOnError)
-	config.RegisterFlags(fs)
+	restconfig.RegisterFlags(fs)
+	configFlags.AddFlags(flag.CommandLine)
 }
 
 func main() {
@@ -21,17 +35,121 @@ func main() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
-	coreHelper, err := core.NewCoreHelper()
+
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(ctx, args); err != nil {
+			klog.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	coreHelper, err := core.NewCoreHelper(ctx, configFlags)
 	if err != nil {
 		klog.Errorf("failed to create coreHelper: %s", err)
+		// an invalid config must not be replaced by the defaults silently, nor an untrusted chart be skipped
+		var invalidConfigErr *config.InvalidConfigError
+		if errors.As(err, &invalidConfigErr) || isVerificationError(err) {
+			os.Exit(1)
+		}
 		return
 	}
+	failOnError := coreHelper.Config().FailurePolicy == config.FailOnError
 	if err = coreHelper.Run(ctx); err != nil {
 		klog.Errorf("failed to run coreHelper: %s", err)
+		if failOnError || isVerificationError(err) {
+			os.Exit(1)
+		}
 	}
 
 	if err = coreHelper.RunHooks(ctx); err != nil {
 		klog.Errorf("failed to run hooks: %s", err)
+		var invalidConfigErr *config.InvalidConfigError
+		if failOnError || errors.As(err, &invalidConfigErr) {
+			os.Exit(1)
+		}
+	}
+
+	// the conflicts only fail the check by the Fail policy, which must stop helm regardless of the failure policy
+	if err = coreHelper.CheckOwnershipConflicts(ctx); err != nil {
+		klog.Errorf("failed to check ownership conflicts: %s", err)
+		os.Exit(1)
+	}
+}
+
+// isVerificationError reports whether the error is caused by a chart failing its verification, which stops
+// the upgrade regardless of the failure policy.
+func isVerificationError(err error) bool {
+	var verificationErr *download.VerificationError
+	return errors.As(err, &verificationErr)
+}
+
+func runCommand(ctx context.Context, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "hooks" && args[1] == "list":
+		listHooks(os.Stdout)
+		return nil
+	case len(args) >= 2 && args[0] == "config" && args[1] == "show":
+		return showConfig(ctx, os.Stdout, args[2:])
+	default:
+		return fmt.Errorf("unknown command: %s", strings.Join(args, " "))
+	}
+}
+
+// showConfig prints the effective upgrade config of the release, with `--explain` it prints
+// the source of each field instead.
+func showConfig(ctx context.Context, w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	explain := fs.Bool("explain", false, "print the source of each effective field")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	coreHelper, err := core.NewCoreHelper(ctx, configFlags)
+	if err != nil {
+		return fmt.Errorf("failed to create coreHelper: %s", err)
 	}
 
+	if !*explain {
+		values, err := config.Redact(coreHelper.Config())
+		if err != nil {
+			return err
+		}
+		data, err := yaml.Marshal(values)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	explanation := coreHelper.Explanation().Redacted()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE\tSOURCE")
+	for _, path := range explanation.Paths() {
+		origin := explanation[path]
+		value, err := json.Marshal(origin.Value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", path, value, origin.Source)
+	}
+	return tw.Flush()
+}
+
+// listHooks prints the registered hooks and the schema of their dynamic options.
+func listHooks(w io.Writer) {
+	for _, info := range hooks.List() {
+		release := "extension"
+		if info.Agent {
+			release = "agent"
+		}
+		fmt.Fprintf(w, "%s (%s)\n", info.Name, release)
+		if provider, ok := info.Hook.(hooks.OptionsProvider); ok {
+			fmt.Fprintln(w, "  dynamicOptions schema:")
+			for _, line := range strings.Split(provider.OptionsSchema(), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+	}
 }
@@ -0,0 +1,193 @@
+package actions
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/chart"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// ActionsFile is the file in the chart archive declaring the migration actions.
+const ActionsFile = "upgrade/actions.yaml"
+
+type Operation string
+
+const (
+	// OperationPatch patches the targets with Patch.
+	OperationPatch Operation = "patch"
+	// OperationDelete deletes the targets.
+	OperationDelete Operation = "delete"
+	// OperationAdoptIntoRelease marks the targets as owned by the current Helm release.
+	OperationAdoptIntoRelease Operation = "adopt-into-release"
+	// OperationRelabel sets the Labels on the targets, a null value removes the label.
+	OperationRelabel Operation = "relabel"
+	// OperationCreateIfMissing creates Object if it does not exist.
+	OperationCreateIfMissing Operation = "create-if-missing"
+)
+
+type PatchType string
+
+const (
+	MergePatchType PatchType = "merge"
+	JSONPatchType  PatchType = "json"
+)
+
+// ActionSet is the content of ActionsFile.
+type ActionSet struct {
+	Actions []Action `json:"actions"`
+}
+
+type Action struct {
+	Name      string    `json:"name"`
+	Operation Operation `json:"operation"`
+	// Versions limits the action to upgrades between the given version ranges.
+	Versions *VersionRange `json:"versions,omitempty"`
+	// Agent indicates that the action runs for the agent release instead of the extension release.
+	Agent bool `json:"agent,omitempty"`
+	// When limits the action to the given hook actions (install, upgrade), empty means all.
+	When []string `json:"when,omitempty"`
+	// Target selects the objects the operation is applied to, it is derived from Object for create-if-missing.
+	Target Target `json:"target,omitempty"`
+
+	Patch     *runtime.RawExtension `json:"patch,omitempty"`
+	PatchType PatchType             `json:"patchType,omitempty"`
+	Labels    map[string]*string    `json:"labels,omitempty"`
+	Object    *runtime.RawExtension `json:"object,omitempty"`
+}
+
+// VersionRange contains semver constraints (e.g. `< 1.2.4-0`) on the extension versions.
+type VersionRange struct {
+	// From is the constraint on the currently installed version, it never matches a fresh installation.
+	From string `json:"from,omitempty"`
+	// To is the constraint on the target version.
+	To string `json:"to,omitempty"`
+}
+
+// Target selects objects by GVK and either names or label selector.
+type Target struct {
+	APIVersion string                `json:"apiVersion,omitempty"`
+	Kind       string                `json:"kind,omitempty"`
+	Namespace  string                `json:"namespace,omitempty"`
+	Names      []string              `json:"names,omitempty"`
+	Selector   *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// Scope describes the release the actions are executed for.
+type Scope struct {
+	ReleaseName      string
+	ReleaseNamespace string
+	Action           string
+	Agent            bool
+	CurrentVersion   string
+	TargetVersion    string
+}
+
+// Load loads the actions declared in the chart, it returns nil if the chart does not contain ActionsFile.
+func Load(ch *chart.Chart) ([]Action, error) {
+	for _, f := range ch.Files {
+		if f.Name != ActionsFile {
+			continue
+		}
+		set := &ActionSet{}
+		if err := yaml.UnmarshalStrict(f.Data, set); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", ActionsFile, err)
+		}
+		for i := range set.Actions {
+			if err := set.Actions[i].Validate(); err != nil {
+				return nil, fmt.Errorf("invalid action %d in %s: %v", i, ActionsFile, err)
+			}
+		}
+		return set.Actions, nil
+	}
+	return nil, nil
+}
+
+func (a *Action) Validate() error {
+	switch a.Operation {
+	case OperationPatch:
+		if a.Patch == nil || len(a.Patch.Raw) == 0 {
+			return fmt.Errorf("action %q: patch is required", a.Name)
+		}
+		if a.PatchType != "" && a.PatchType != MergePatchType && a.PatchType != JSONPatchType {
+			return fmt.Errorf("action %q: unsupported patchType %q", a.Name, a.PatchType)
+		}
+	case OperationRelabel:
+		if len(a.Labels) == 0 {
+			return fmt.Errorf("action %q: labels is required", a.Name)
+		}
+	case OperationCreateIfMissing:
+		if a.Object == nil || len(a.Object.Raw) == 0 {
+			return fmt.Errorf("action %q: object is required", a.Name)
+		}
+		return a.validateVersions()
+	case OperationDelete, OperationAdoptIntoRelease:
+	default:
+		return fmt.Errorf("action %q: unsupported operation %q", a.Name, a.Operation)
+	}
+	if a.Target.APIVersion == "" || a.Target.Kind == "" {
+		return fmt.Errorf("action %q: target apiVersion and kind are required", a.Name)
+	}
+	if len(a.Target.Names) == 0 && a.Target.Selector == nil {
+		return fmt.Errorf("action %q: target names or selector is required", a.Name)
+	}
+	return a.validateVersions()
+}
+
+func (a *Action) validateVersions() error {
+	if a.Versions == nil {
+		return nil
+	}
+	for _, c := range []string{a.Versions.From, a.Versions.To} {
+		if c == "" {
+			continue
+		}
+		if _, err := semver.NewConstraint(c); err != nil {
+			return fmt.Errorf("action %q: invalid version constraint %q: %v", a.Name, c, err)
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the action should be executed in the given scope.
+func (a *Action) Matches(scope *Scope) bool {
+	if a.Agent != scope.Agent {
+		return false
+	}
+	if len(a.When) > 0 {
+		found := false
+		for _, when := range a.When {
+			if when == scope.Action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if a.Versions == nil {
+		return true
+	}
+	return matchVersion(a.Versions.From, scope.CurrentVersion) && matchVersion(a.Versions.To, scope.TargetVersion)
+}
+
+func matchVersion(constraint, v string) bool {
+	if constraint == "" {
+		return true
+	}
+	if v == "" {
+		return false
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return false
+	}
+	version, err := semver.NewVersion(v)
+	if err != nil {
+		return false
+	}
+	return c.Check(version)
+}
@@ -0,0 +1,174 @@
+package actions
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var (
+	globalRoleGVK = schema.GroupVersionKind{Group: "iam.kubesphere.io", Version: "v1beta1", Kind: "GlobalRole"}
+	configMapGVK  = schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+)
+
+const testActions = `
+actions:
+- name: adopt-roles
+  operation: adopt-into-release
+  versions:
+    from: "< 1.2.4-0"
+    to: ">= 1.2.4-0"
+  target:
+    apiVersion: iam.kubesphere.io/v1beta1
+    kind: GlobalRole
+    names: [devops-anonymous, devops-missing]
+- name: relabel-roles
+  operation: relabel
+  target:
+    apiVersion: iam.kubesphere.io/v1beta1
+    kind: GlobalRole
+    selector:
+      matchLabels:
+        app: devops
+  labels:
+    app: null
+    tier: devops
+- name: patch-config
+  operation: patch
+  when: [upgrade]
+  target:
+    apiVersion: v1
+    kind: ConfigMap
+    names: [devops-config]
+  patch:
+    data:
+      foo: bar
+- name: delete-obsolete
+  operation: delete
+  target:
+    apiVersion: v1
+    kind: ConfigMap
+    names: [obsolete]
+- name: create-config
+  operation: create-if-missing
+  object:
+    apiVersion: v1
+    kind: ConfigMap
+    metadata:
+      name: created
+    data:
+      foo: bar
+- name: agent-only
+  operation: delete
+  agent: true
+  target:
+    apiVersion: v1
+    kind: ConfigMap
+    names: [devops-config]
+`
+
+func newObject(gvk schema.GroupVersionKind, namespace, name string, labels map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	u.SetLabels(labels)
+	return u
+}
+
+func TestLoad(t *testing.T) {
+	loaded, err := Load(&chart.Chart{Files: []*chart.File{{Name: ActionsFile, Data: []byte(testActions)}}})
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 6)
+
+	_, err = Load(&chart.Chart{Files: []*chart.File{{Name: ActionsFile, Data: []byte(`
+actions:
+- name: invalid
+  operation: rename
+`)}}})
+	assert.ErrorContains(t, err, "unsupported operation")
+
+	_, err = Load(&chart.Chart{Files: []*chart.File{{Name: ActionsFile, Data: []byte(`
+actions:
+- name: invalid
+  operation: delete
+  versions:
+    from: "~>>1"
+  target:
+    apiVersion: v1
+    kind: ConfigMap
+    names: [foo]
+`)}}})
+	assert.ErrorContains(t, err, "invalid version constraint")
+
+	loaded, err = Load(&chart.Chart{})
+	assert.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func TestActionMatches(t *testing.T) {
+	action := &Action{Versions: &VersionRange{From: "< 1.2.4-0", To: ">= 1.2.4-0"}, When: []string{"upgrade"}}
+	assert.True(t, action.Matches(&Scope{Action: "upgrade", CurrentVersion: "1.1.0", TargetVersion: "1.2.4"}))
+	assert.False(t, action.Matches(&Scope{Action: "upgrade", CurrentVersion: "1.2.4", TargetVersion: "1.2.5"}))
+	assert.False(t, action.Matches(&Scope{Action: "install", CurrentVersion: "1.1.0", TargetVersion: "1.2.4"}))
+	assert.False(t, action.Matches(&Scope{Action: "upgrade", TargetVersion: "1.2.4"}))
+	assert.False(t, action.Matches(&Scope{Action: "upgrade", Agent: true, CurrentVersion: "1.1.0", TargetVersion: "1.2.4"}))
+}
+
+func TestEngineRun(t *testing.T) {
+	scheme := runtime.NewScheme()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme,
+		map[schema.GroupVersionResource]string{
+			globalRoleGVK.GroupVersion().WithResource("globalroles"): "GlobalRoleList",
+			configMapGVK.GroupVersion().WithResource("configmaps"):   "ConfigMapList",
+		},
+		newObject(globalRoleGVK, "", "devops-anonymous", map[string]string{"app": "devops"}),
+		newObject(configMapGVK, "extension-devops", "devops-config", nil),
+		newObject(configMapGVK, "extension-devops", "obsolete", nil),
+	)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(globalRoleGVK, meta.RESTScopeRoot)
+	mapper.Add(configMapGVK, meta.RESTScopeNamespace)
+
+	loaded, err := Load(&chart.Chart{Files: []*chart.File{{Name: ActionsFile, Data: []byte(testActions)}}})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	err = NewEngine(client, mapper).Run(ctx, loaded, &Scope{
+		ReleaseName:      "devops",
+		ReleaseNamespace: "extension-devops",
+		Action:           "upgrade",
+		CurrentVersion:   "1.2.0",
+		TargetVersion:    "1.2.4",
+	})
+	assert.NoError(t, err)
+
+	globalRoles := client.Resource(globalRoleGVK.GroupVersion().WithResource("globalroles"))
+	configMaps := client.Resource(configMapGVK.GroupVersion().WithResource("configmaps")).Namespace("extension-devops")
+
+	role, err := globalRoles.Get(ctx, "devops-anonymous", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"meta.helm.sh/release-name":      "devops",
+		"meta.helm.sh/release-namespace": "extension-devops",
+	}, role.GetAnnotations())
+	assert.Equal(t, map[string]string{"app.kubernetes.io/managed-by": "Helm", "tier": "devops"}, role.GetLabels())
+
+	cm, err := configMaps.Get(ctx, "devops-config", metav1.GetOptions{})
+	assert.NoError(t, err)
+	data, _, _ := unstructured.NestedStringMap(cm.Object, "data")
+	assert.Equal(t, map[string]string{"foo": "bar"}, data)
+
+	_, err = configMaps.Get(ctx, "obsolete", metav1.GetOptions{})
+	assert.Error(t, err)
+	_, err = configMaps.Get(ctx, "created", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,206 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/adoption"
+)
+
+// Engine executes the declared actions with the dynamic client.
+type Engine struct {
+	client dynamic.Interface
+	mapper meta.RESTMapper
+}
+
+func NewEngine(client dynamic.Interface, mapper meta.RESTMapper) *Engine {
+	return &Engine{
+		client: client,
+		mapper: mapper,
+	}
+}
+
+// Run executes the actions matching the scope in order, it stops at the first failed action.
+func (e *Engine) Run(ctx context.Context, actions []Action, scope *Scope) error {
+	for i := range actions {
+		action := &actions[i]
+		if !action.Matches(scope) {
+			continue
+		}
+		klog.Infof("running action %s: %s %s/%s\n", action.Name, action.Operation, action.Target.APIVersion, action.Target.Kind)
+		if err := e.run(ctx, action, scope); err != nil {
+			return fmt.Errorf("failed to run action %s: %v", action.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) run(ctx context.Context, action *Action, scope *Scope) error {
+	if action.Operation == OperationCreateIfMissing {
+		return e.createIfMissing(ctx, action, scope)
+	}
+
+	resource, namespace, err := e.resourceFor(action.Target.APIVersion, action.Target.Kind, action.Target.Namespace, scope)
+	if err != nil {
+		return err
+	}
+	targets, err := e.listTargets(ctx, resource, action.Target)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		var err error
+		switch action.Operation {
+		case OperationDelete:
+			klog.Infof("deleting %s %s\n", action.Target.Kind, objectName(namespace, target.GetName()))
+			err = resource.Delete(ctx, target.GetName(), metav1.DeleteOptions{})
+		case OperationPatch:
+			patchType := types.MergePatchType
+			if action.PatchType == JSONPatchType {
+				patchType = types.JSONPatchType
+			}
+			klog.Infof("patching %s %s\n", action.Target.Kind, objectName(namespace, target.GetName()))
+			_, err = resource.Patch(ctx, target.GetName(), patchType, action.Patch.Raw, metav1.PatchOptions{})
+		case OperationRelabel:
+			klog.Infof("relabeling %s %s\n", action.Target.Kind, objectName(namespace, target.GetName()))
+			err = e.mergePatch(ctx, resource, target.GetName(), map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": action.Labels},
+			})
+		case OperationAdoptIntoRelease:
+			err = e.adopt(ctx, resource, &target, scope)
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) createIfMissing(ctx context.Context, action *Action, scope *Scope) error {
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(action.Object.Raw, &obj.Object); err != nil {
+		return fmt.Errorf("failed to decode object: %v", err)
+	}
+	resource, namespace, err := e.resourceFor(obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), scope)
+	if err != nil {
+		return err
+	}
+	if namespace != "" {
+		obj.SetNamespace(namespace)
+	}
+
+	if _, err := resource.Get(ctx, obj.GetName(), metav1.GetOptions{}); err == nil {
+		return nil
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+	klog.Infof("creating %s %s\n", obj.GetKind(), objectName(namespace, obj.GetName()))
+	if _, err := resource.Create(ctx, obj, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// resourceFor maps the GVK to the resource client, namespaced resources default to the release namespace.
+func (e *Engine) resourceFor(apiVersion, kind, namespace string, scope *Scope) (dynamic.ResourceInterface, string, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, "", err
+	}
+	mapping, err := e.mapper.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get rest mapping of %s: %v", gv.WithKind(kind), err)
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return e.client.Resource(mapping.Resource), "", nil
+	}
+	if namespace == "" {
+		namespace = scope.ReleaseNamespace
+	}
+	return e.client.Resource(mapping.Resource).Namespace(namespace), namespace, nil
+}
+
+func (e *Engine) listTargets(ctx context.Context, resource dynamic.ResourceInterface, target Target) ([]unstructured.Unstructured, error) {
+	if target.Selector == nil {
+		var targets []unstructured.Unstructured
+		for _, name := range target.Names {
+			obj, err := resource.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			targets = append(targets, *obj)
+		}
+		return targets, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(target.Selector)
+	if err != nil {
+		return nil, err
+	}
+	list, err := resource.List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	if len(target.Names) == 0 {
+		return list.Items, nil
+	}
+	var targets []unstructured.Unstructured
+	for _, item := range list.Items {
+		for _, name := range target.Names {
+			if item.GetName() == name {
+				targets = append(targets, item)
+				break
+			}
+		}
+	}
+	return targets, nil
+}
+
+// adopt stamps the Helm ownership markers of the release on the target, it fails if the target is owned by another release.
+func (e *Engine) adopt(ctx context.Context, resource dynamic.ResourceInterface, target *unstructured.Unstructured, scope *Scope) error {
+	release := adoption.Release{Name: scope.ReleaseName, Namespace: scope.ReleaseNamespace}
+	switch adoption.CheckOwnership(target, release) {
+	case adoption.OwnedByRelease:
+		return nil
+	case adoption.OwnedByOther:
+		return fmt.Errorf("%s %s is owned by release %s/%s", target.GetKind(), objectName(target.GetNamespace(), target.GetName()),
+			target.GetAnnotations()[adoption.ReleaseNamespaceAnnotation], target.GetAnnotations()[adoption.ReleaseNameAnnotation])
+	}
+	patch, err := adoption.MergePatch(release)
+	if err != nil {
+		return err
+	}
+	klog.Infof("adopting %s %s into release %s/%s\n", target.GetKind(), objectName(target.GetNamespace(), target.GetName()), release.Namespace, release.Name)
+	_, err = resource.Patch(ctx, target.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func (e *Engine) mergePatch(ctx context.Context, resource dynamic.ResourceInterface, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = resource.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
+
+func objectName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
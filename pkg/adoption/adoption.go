@@ -0,0 +1,245 @@
+package adoption
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ReleaseNameAnnotation      = "meta.helm.sh/release-name"
+	ReleaseNamespaceAnnotation = "meta.helm.sh/release-namespace"
+	ManagedByLabel             = "app.kubernetes.io/managed-by"
+	ManagedByHelm              = "Helm"
+)
+
+// Release identifies the Helm release adopting the resources.
+type Release struct {
+	Name      string
+	Namespace string
+}
+
+type Ownership int
+
+const (
+	// Unowned means the object is missing some ownership markers and is not owned by another release.
+	Unowned Ownership = iota
+	// OwnedByRelease means the object carries all ownership markers of the release.
+	OwnedByRelease
+	// OwnedByOther means the object belongs to another release and can not be adopted.
+	OwnedByOther
+)
+
+// CheckOwnership checks the ownership markers of the object the same way as Helm does before importing it.
+func CheckOwnership(obj metav1.Object, release Release) Ownership {
+	name := obj.GetAnnotations()[ReleaseNameAnnotation]
+	namespace := obj.GetAnnotations()[ReleaseNamespaceAnnotation]
+	if (name != "" && name != release.Name) || (namespace != "" && namespace != release.Namespace) {
+		return OwnedByOther
+	}
+	if name == release.Name && namespace == release.Namespace && obj.GetLabels()[ManagedByLabel] == ManagedByHelm {
+		return OwnedByRelease
+	}
+	return Unowned
+}
+
+// MergePatch returns the JSON merge patch stamping all ownership markers of the release.
+func MergePatch(release Release) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				ReleaseNameAnnotation:      release.Name,
+				ReleaseNamespaceAnnotation: release.Namespace,
+			},
+			"labels": map[string]string{
+				ManagedByLabel: ManagedByHelm,
+			},
+		},
+	})
+}
+
+// Selector selects the resources to adopt by GVK and either names or label selector.
+type Selector struct {
+	GroupVersionKind schema.GroupVersionKind
+	Namespace        string
+	Names            []string
+	LabelSelector    *metav1.LabelSelector
+}
+
+// ObjectRef identifies an object in the Report.
+type ObjectRef struct {
+	schema.GroupVersionKind
+	Namespace string
+	Name      string
+}
+
+func (r ObjectRef) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s %s", r.Kind, r.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// Conflict is an object owned by another release.
+type Conflict struct {
+	ObjectRef
+	ReleaseName      string
+	ReleaseNamespace string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s is owned by release %s/%s", c.ObjectRef, c.ReleaseNamespace, c.ReleaseName)
+}
+
+type Report struct {
+	// Adopted contains the objects stamped with the ownership markers.
+	Adopted []ObjectRef
+	// Owned contains the objects already owned by the release.
+	Owned     []ObjectRef
+	Conflicts []Conflict
+}
+
+// Adopter stamps the Helm ownership markers on existing resources so that Helm can import them into the release.
+type Adopter struct {
+	client  client.Client
+	release Release
+	dryRun  bool
+
+	takeOver       bool
+	previousOwners []string
+}
+
+func NewAdopter(cli client.Client, release Release) *Adopter {
+	return &Adopter{
+		client:  cli,
+		release: release,
+	}
+}
+
+// WithDryRun only reports the ownership of the resources without stamping them.
+func (a *Adopter) WithDryRun(dryRun bool) *Adopter {
+	a.dryRun = dryRun
+	return a
+}
+
+// WithTakeOver takes over the objects owned by the previous owners, i.e. the names of the releases, or by any
+// other release if no previous owner is given. It is meant for the resources moved between releases by a known
+// migration, the other conflicts are still reported.
+func (a *Adopter) WithTakeOver(previousOwners ...string) *Adopter {
+	a.takeOver = true
+	a.previousOwners = previousOwners
+	return a
+}
+
+// Adopt adopts the resources matching the selectors, missing resources are ignored.
+func (a *Adopter) Adopt(ctx context.Context, selectors []Selector) (*Report, error) {
+	report := &Report{}
+	for _, selector := range selectors {
+		objs, err := a.list(ctx, selector)
+		if err != nil {
+			return report, err
+		}
+		for _, obj := range objs {
+			if err := a.AdoptObject(ctx, obj, report); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// AdoptObject adopts the live object and records the result in the report.
+func (a *Adopter) AdoptObject(ctx context.Context, obj *unstructured.Unstructured, report *Report) error {
+	ref := ObjectRef{GroupVersionKind: obj.GroupVersionKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	switch CheckOwnership(obj, a.release) {
+	case OwnedByRelease:
+		report.Owned = append(report.Owned, ref)
+		return nil
+	case OwnedByOther:
+		conflict := Conflict{
+			ObjectRef:        ref,
+			ReleaseName:      obj.GetAnnotations()[ReleaseNameAnnotation],
+			ReleaseNamespace: obj.GetAnnotations()[ReleaseNamespaceAnnotation],
+		}
+		if !a.takesOver(conflict.ReleaseName) {
+			klog.Warningf("%s, skip adopting it into release %s/%s", conflict, a.release.Namespace, a.release.Name)
+			report.Conflicts = append(report.Conflicts, conflict)
+			return nil
+		}
+		klog.Infof("%s, taking it over into release %s/%s", conflict, a.release.Namespace, a.release.Name)
+	}
+
+	if !a.dryRun {
+		patch, err := MergePatch(a.release)
+		if err != nil {
+			return err
+		}
+		klog.Infof("adopting %s into release %s/%s", ref, a.release.Namespace, a.release.Name)
+		if err := a.client.Patch(ctx, obj, client.RawPatch(client.Merge.Type(), patch)); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to adopt %s: %v", ref, err)
+		}
+	}
+	report.Adopted = append(report.Adopted, ref)
+	return nil
+}
+
+func (a *Adopter) takesOver(owner string) bool {
+	if !a.takeOver {
+		return false
+	}
+	return len(a.previousOwners) == 0 || contains(a.previousOwners, owner)
+}
+
+func (a *Adopter) list(ctx context.Context, selector Selector) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+	if selector.LabelSelector == nil {
+		for _, name := range selector.Names {
+			obj := &unstructured.Unstructured{}
+			obj.SetGroupVersionKind(selector.GroupVersionKind)
+			if err := a.client.Get(ctx, client.ObjectKey{Namespace: selector.Namespace, Name: name}, obj); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			objs = append(objs, obj)
+		}
+		return objs, nil
+	}
+
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(selector.GroupVersionKind.GroupVersion().WithKind(selector.GroupVersionKind.Kind + "List"))
+	if err := a.client.List(ctx, list, client.InNamespace(selector.Namespace), client.MatchingLabelsSelector{Selector: labelSelector}); err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		if len(selector.Names) > 0 && !contains(selector.Names, list.Items[i].GetName()) {
+			continue
+		}
+		objs = append(objs, &list.Items[i])
+	}
+	return objs, nil
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package adoption
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newConfigMap(name string, labels, annotations map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "extension-devops",
+		Name:        name,
+		Labels:      labels,
+		Annotations: annotations,
+	}}
+}
+
+func TestCheckOwnership(t *testing.T) {
+	release := Release{Name: "devops", Namespace: "extension-devops"}
+	assert.Equal(t, Unowned, CheckOwnership(newConfigMap("a", nil, nil), release))
+	assert.Equal(t, Unowned, CheckOwnership(newConfigMap("a", nil, map[string]string{ReleaseNameAnnotation: "devops"}), release))
+	assert.Equal(t, OwnedByRelease, CheckOwnership(newConfigMap("a", map[string]string{ManagedByLabel: ManagedByHelm}, map[string]string{
+		ReleaseNameAnnotation:      "devops",
+		ReleaseNamespaceAnnotation: "extension-devops",
+	}), release))
+	assert.Equal(t, OwnedByOther, CheckOwnership(newConfigMap("a", nil, map[string]string{ReleaseNameAnnotation: "other"}), release))
+	assert.Equal(t, OwnedByOther, CheckOwnership(newConfigMap("a", nil, map[string]string{
+		ReleaseNameAnnotation:      "devops",
+		ReleaseNamespaceAnnotation: "kubesphere-devops-system",
+	}), release))
+}
+
+func TestAdopterAdopt(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newConfigMap("unowned", map[string]string{"app": "devops"}, map[string]string{ReleaseNameAnnotation: "devops"}),
+		newConfigMap("owned", map[string]string{"app": "devops", ManagedByLabel: ManagedByHelm}, map[string]string{
+			ReleaseNameAnnotation:      "devops",
+			ReleaseNamespaceAnnotation: "extension-devops",
+		}),
+		newConfigMap("other", map[string]string{"app": "devops"}, map[string]string{ReleaseNameAnnotation: "other"}),
+	).Build()
+
+	release := Release{Name: "devops", Namespace: "extension-devops"}
+	gvk := corev1.SchemeGroupVersion.WithKind("ConfigMap")
+	ctx := context.Background()
+
+	report, err := NewAdopter(cli, release).WithDryRun(true).Adopt(ctx, []Selector{{
+		GroupVersionKind: gvk,
+		Namespace:        "extension-devops",
+		Names:            []string{"unowned", "missing"},
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, report.Adopted, 1)
+	cm := &corev1.ConfigMap{}
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "extension-devops", Name: "unowned"}, cm))
+	assert.Equal(t, Unowned, CheckOwnership(cm, release))
+
+	report, err = NewAdopter(cli, release).Adopt(ctx, []Selector{{
+		GroupVersionKind: gvk,
+		Namespace:        "extension-devops",
+		LabelSelector:    &metav1.LabelSelector{MatchLabels: map[string]string{"app": "devops"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "ConfigMap extension-devops/unowned", report.Adopted[0].String())
+	assert.Equal(t, "ConfigMap extension-devops/owned", report.Owned[0].String())
+	assert.Equal(t, "ConfigMap extension-devops/other is owned by release /other", report.Conflicts[0].String())
+
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "extension-devops", Name: "unowned"}, cm))
+	assert.Equal(t, OwnedByRelease, CheckOwnership(cm, release))
+	assert.Equal(t, "devops", cm.Labels["app"])
+}
+
+func TestAdopterTakeOver(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newConfigMap("legacy", nil, map[string]string{ReleaseNameAnnotation: "ks-devops", ReleaseNamespaceAnnotation: "kubesphere-devops-system"}),
+		newConfigMap("other", nil, map[string]string{ReleaseNameAnnotation: "other"}),
+	).Build()
+
+	release := Release{Name: "devops", Namespace: "extension-devops"}
+	ctx := context.Background()
+	report, err := NewAdopter(cli, release).WithTakeOver("ks-devops").Adopt(ctx, []Selector{{
+		GroupVersionKind: corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+		Namespace:        "extension-devops",
+		Names:            []string{"legacy", "other"},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, "ConfigMap extension-devops/legacy", report.Adopted[0].String())
+	assert.Equal(t, "ConfigMap extension-devops/other is owned by release /other", report.Conflicts[0].String())
+
+	cm := &corev1.ConfigMap{}
+	assert.NoError(t, cli.Get(ctx, client.ObjectKey{Namespace: "extension-devops", Name: "legacy"}, cm))
+	assert.Equal(t, OwnedByRelease, CheckOwnership(cm, release))
+
+	report, err = NewAdopter(cli, release).WithTakeOver().Adopt(ctx, []Selector{{
+		GroupVersionKind: corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+		Namespace:        "extension-devops",
+		Names:            []string{"other"},
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, report.Adopted, 1)
+	assert.Empty(t, report.Conflicts)
+}
@@ -0,0 +1,173 @@
+package adoption
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const notesFileSuffix = "NOTES.txt"
+
+// RenderOptions configures the rendering of the chart.
+type RenderOptions struct {
+	Release   Release
+	IsUpgrade bool
+	// Capabilities defaults to chartutil.DefaultCapabilities.
+	Capabilities *chartutil.Capabilities
+	// RestConfig enables the `lookup` function in templates.
+	RestConfig *rest.Config
+}
+
+// RenderObjects renders the chart the same way as `helm upgrade` and returns the objects owned by the
+// release. Hooks, CRDs and NOTES.txt are excluded since Helm never imports them into the release.
+// The chart is copied before processing the dependencies, so it is left untouched.
+func RenderObjects(ch *chart.Chart, values chartutil.Values, opts RenderOptions) ([]*unstructured.Unstructured, error) {
+	ch, err := copyChart(ch)
+	if err != nil {
+		return nil, err
+	}
+	if err := chartutil.ProcessDependenciesWithMerge(ch, values); err != nil {
+		return nil, fmt.Errorf("failed to process chart dependencies: %v", err)
+	}
+
+	caps := opts.Capabilities
+	if caps == nil {
+		caps = chartutil.DefaultCapabilities
+	}
+	renderValues, err := chartutil.ToRenderValues(ch, values, chartutil.ReleaseOptions{
+		Name:      opts.Release.Name,
+		Namespace: opts.Release.Namespace,
+		Revision:  1,
+		IsInstall: !opts.IsUpgrade,
+		IsUpgrade: opts.IsUpgrade,
+	}, caps)
+	if err != nil {
+		return nil, err
+	}
+
+	var files map[string]string
+	if opts.RestConfig != nil {
+		files, err = engine.RenderWithClient(ch, renderValues, opts.RestConfig)
+	} else {
+		files, err = engine.Render(ch, renderValues)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to render chart: %v", err)
+	}
+	for name := range files {
+		if strings.HasSuffix(name, notesFileSuffix) {
+			delete(files, name)
+		}
+	}
+
+	_, manifests, err := releaseutil.SortManifests(files, nil, releaseutil.InstallOrder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendered manifests: %v", err)
+	}
+
+	var objs []*unstructured.Unstructured
+	for _, manifest := range manifests {
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal([]byte(manifest.Content), &obj.Object); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", manifest.Name, err)
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// AdoptObjects adopts the live objects corresponding to the given objects, which are usually rendered
+// from the target chart. Objects that do not exist or whose kind is unknown to the cluster are ignored,
+// namespaced objects without namespace belong to the release namespace.
+func (a *Adopter) AdoptObjects(ctx context.Context, objs []*unstructured.Unstructured) (*Report, error) {
+	report := &Report{}
+	for _, obj := range objs {
+		namespaced, err := a.client.IsObjectNamespaced(obj)
+		if err != nil {
+			// the kind is not served by the cluster yet, e.g. the CRD is installed by this release
+			continue
+		}
+		namespace := ""
+		if namespaced {
+			namespace = obj.GetNamespace()
+			if namespace == "" {
+				namespace = a.release.Namespace
+			}
+		}
+
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(obj.GroupVersionKind())
+		if err := a.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: obj.GetName()}, live); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return report, err
+		}
+		if err := a.AdoptObject(ctx, live, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// copyChart copies the chart and its dependencies deep enough for processing the dependencies,
+// which modifies the metadata, values and dependencies of the chart in place.
+func copyChart(ch *chart.Chart) (*chart.Chart, error) {
+	out := &chart.Chart{
+		Raw:       ch.Raw,
+		Lock:      ch.Lock,
+		Templates: ch.Templates,
+		Schema:    ch.Schema,
+		Files:     ch.Files,
+	}
+	if ch.Metadata != nil {
+		metadata := *ch.Metadata
+		metadata.Dependencies = make([]*chart.Dependency, 0, len(ch.Metadata.Dependencies))
+		for _, dep := range ch.Metadata.Dependencies {
+			d := *dep
+			metadata.Dependencies = append(metadata.Dependencies, &d)
+		}
+		out.Metadata = &metadata
+	}
+
+	values, err := copyValues(ch.Values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy values of chart %s: %v", ch.Name(), err)
+	}
+	out.Values = values
+
+	deps := make([]*chart.Chart, 0, len(ch.Dependencies()))
+	for _, dep := range ch.Dependencies() {
+		d, err := copyChart(dep)
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, d)
+	}
+	out.SetDependencies(deps...)
+	return out, nil
+}
+
+func copyValues(values map[string]interface{}) (chartutil.Values, error) {
+	if values == nil {
+		return nil, nil
+	}
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return chartutil.ReadValues(data)
+}
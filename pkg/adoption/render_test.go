@@ -0,0 +1,78 @@
+package adoption
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestChart() *chart.Chart {
+	sub := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "agent", Version: "0.1.0"},
+		Templates: []*chart.File{
+			{Name: "templates/cm.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: agent\n")},
+		},
+	}
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "devops",
+			Version:    "1.2.4",
+			Dependencies: []*chart.Dependency{
+				{Name: "agent", Version: "0.1.0", Tags: []string{"agent"}},
+			},
+		},
+		Values: map[string]interface{}{"name": "devops-config"},
+		Templates: []*chart.File{
+			{Name: "templates/cm.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Values.name }}\n  namespace: {{ .Release.Namespace }}\n")},
+			{Name: "templates/hook.yaml", Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: hook\n  annotations:\n    helm.sh/hook: pre-upgrade\n")},
+			{Name: "templates/NOTES.txt", Data: []byte("Thank you for installing {{ .Chart.Name }}.")},
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{- define "devops.name" -}}devops{{- end -}}`)},
+		},
+	}
+	ch.SetDependencies(sub)
+	return ch
+}
+
+func TestRenderObjects(t *testing.T) {
+	ch := newTestChart()
+	release := Release{Name: "devops", Namespace: "extension-devops"}
+
+	objs, err := RenderObjects(ch, map[string]interface{}{"tags": map[string]interface{}{"agent": false}}, RenderOptions{Release: release, IsUpgrade: true})
+	assert.NoError(t, err)
+	assert.Len(t, objs, 1)
+	assert.Equal(t, "devops-config", objs[0].GetName())
+	assert.Equal(t, "extension-devops", objs[0].GetNamespace())
+
+	objs, err = RenderObjects(ch, map[string]interface{}{"name": "custom"}, RenderOptions{Release: release})
+	assert.NoError(t, err)
+	assert.Len(t, objs, 2)
+	// the chart itself is not modified by processing the dependencies
+	assert.Len(t, ch.Dependencies(), 1)
+	assert.Equal(t, "devops-config", ch.Values["name"])
+}
+
+func TestAdoptObjects(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithObjects(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "extension-devops", Name: "agent"}},
+	).Build()
+	release := Release{Name: "devops", Namespace: "extension-devops"}
+
+	objs, err := RenderObjects(newTestChart(), nil, RenderOptions{Release: release})
+	assert.NoError(t, err)
+	report, err := NewAdopter(cli, release).WithDryRun(true).AdoptObjects(context.Background(), objs)
+	assert.NoError(t, err)
+	assert.Len(t, report.Adopted, 1)
+	assert.Equal(t, "agent", report.Adopted[0].Name)
+}
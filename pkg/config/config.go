@@ -1,8 +1,9 @@
 package config
 
 import (
-	"gopkg.in/yaml.v2"
-	"helm.sh/helm/v3/pkg/chartutil"
+	"encoding/json"
+	"fmt"
+	"strconv"
 
 	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
 )
@@ -22,8 +23,14 @@ type ExtensionUpgradeHookConfig struct {
 	MergeValues bool `json:"mergeValues,omitempty" yaml:"mergeValues,omitempty"`
 	// FailurePolicy indicates the policy to use when an error occurs during the upgrade process.
 	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty" yaml:"failurePolicy,omitempty"`
+	// OwnershipConflictPolicy indicates how to handle the resources of the target chart that already exist
+	// but are not owned by the release, which makes `helm upgrade` fail. Defaults to Report.
+	OwnershipConflictPolicy OwnershipConflictPolicy `json:"ownershipConflictPolicy,omitempty" yaml:"ownershipConflictPolicy,omitempty"`
 	// DynamicOptions contains dynamic options for the extension.
 	DynamicOptions DynamicOptions `json:"dynamicOptions,omitempty" yaml:"dynamicOptions,omitempty"`
+	// DownloadOptions configures the downloader of the charts, the top-level Config.DownloadOptions of the
+	// same configuration source is used as its base.
+	DownloadOptions *download.Options `json:"downloadOptions,omitempty" yaml:"downloadOptions,omitempty"`
 }
 
 type DynamicOptions map[string]interface{}
@@ -37,6 +44,68 @@ const (
 	FailOnError
 )
 
+var failurePolicyNames = map[FailurePolicy]string{
+	IgnoreError: "IgnoreError",
+	FailOnError: "FailOnError",
+}
+
+// ParseFailurePolicy parses the name (IgnoreError, FailOnError) or the number of the failure policy.
+func ParseFailurePolicy(s string) (FailurePolicy, error) {
+	for policy, name := range failurePolicyNames {
+		if s == name {
+			return policy, nil
+		}
+	}
+	if i, err := strconv.Atoi(s); err == nil {
+		if _, ok := failurePolicyNames[FailurePolicy(i)]; ok {
+			return FailurePolicy(i), nil
+		}
+	}
+	return IgnoreError, fmt.Errorf("unsupported failurePolicy %q, expected IgnoreError or FailOnError", s)
+}
+
+func (p FailurePolicy) String() string {
+	if name, ok := failurePolicyNames[p]; ok {
+		return name
+	}
+	return strconv.Itoa(int(p))
+}
+
+func (p FailurePolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON accepts both the name and the number of the failure policy.
+func (p *FailurePolicy) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var i int
+		if err := json.Unmarshal(data, &i); err != nil {
+			return fmt.Errorf("failurePolicy must be a string or an integer, got %s", data)
+		}
+		s = strconv.Itoa(i)
+	}
+	policy, err := ParseFailurePolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+type OwnershipConflictPolicy string
+
+const (
+	// ReportConflicts indicates that the conflicts should only be logged.
+	ReportConflicts OwnershipConflictPolicy = "Report"
+	// AdoptConflicts indicates that the resources not owned by any release should be adopted into the release.
+	AdoptConflicts OwnershipConflictPolicy = "Adopt"
+	// FailOnConflicts indicates that the upgrade should fail if any conflict is found.
+	FailOnConflicts OwnershipConflictPolicy = "Fail"
+	// IgnoreConflicts disables the detection of conflicts.
+	IgnoreConflicts OwnershipConflictPolicy = "Ignore"
+)
+
 func NewConfig() *Config {
 	return &Config{
 		DownloadOptions: download.NewDefaultOptions(),
@@ -72,28 +141,3 @@ func NewConfig() *Config {
 		},
 	}
 }
-
-func LoadConfigFromHelmValues(values chartutil.Values) (*ExtensionUpgradeHookConfig, error) {
-	if values == nil {
-		return nil, nil
-	}
-	global, err := values.Table("global")
-	if err != nil {
-		return nil, err
-	}
-	upgradeConfig, err := global.Table("upgradeConfig")
-	if err != nil {
-		return nil, err
-	}
-	body, err := upgradeConfig.YAML()
-	if err != nil {
-		return nil, err
-	}
-
-	currentCfg := &ExtensionUpgradeHookConfig{}
-	if err := yaml.Unmarshal([]byte(body), currentCfg); err != nil {
-		return nil, err
-	}
-
-	return currentCfg, nil
-}
@@ -1,6 +1,9 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strings"
+)
 
 const (
 	HookEnvAction      = "HOOK_ACTION"
@@ -8,10 +11,16 @@ const (
 	HookEnvClusterName = "CLUSTER_NAME"
 	HookEnvReleaseName = "RELEASE_NAME"
 	HookEnvChartPath   = "CHART_PATH"
+	// HookEnvReleaseNamespace is optional, the namespace of the executor pod is used by default.
+	HookEnvReleaseNamespace = "RELEASE_NAMESPACE"
 
 	ActionInstall   = "install"
 	ActionUpgrade   = "upgrade"
 	ActionUninstall = "uninstall"
+
+	ClusterRoleHost = "host"
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
 func GetHookEnvChartPath() string {
@@ -33,3 +42,16 @@ func GetHookEnvClusterName() string {
 func GetHookEnvReleaseName() string {
 	return os.Getenv(HookEnvReleaseName)
 }
+
+// GetHookEnvReleaseNamespace returns the namespace of the release. The executor job runs in the
+// release namespace, so the namespace of the service account is used if the env is not set.
+func GetHookEnvReleaseNamespace() string {
+	if namespace := os.Getenv(HookEnvReleaseNamespace); namespace != "" {
+		return namespace
+	}
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Flags contains the configuration set on the command line, it is the last configuration layer.
+type Flags struct {
+	// ConfigFiles contains the config files set on the command line, DefaultConfigFile is used if empty.
+	ConfigFiles        []string
+	ConfigMapNamespace string
+	ConfigMapName      string
+
+	values map[string]interface{}
+}
+
+func NewFlags() *Flags {
+	return &Flags{
+		ConfigMapNamespace: DefaultConfigMapNamespace,
+		ConfigMapName:      DefaultConfigMapName,
+		values:             make(map[string]interface{}),
+	}
+}
+
+// AddFlags registers the flags, only the flags set explicitly override the other layers.
+func (f *Flags) AddFlags(fs *flag.FlagSet) {
+	fs.Var((*stringSliceFlag)(&f.ConfigFiles), "config-file", "config file containing a Config, defaults to "+DefaultConfigFile+" if it exists (can be repeated)")
+	fs.StringVar(&f.ConfigMapNamespace, "config-namespace", DefaultConfigMapNamespace, "namespace of the ConfigMap containing the cluster-wide upgrade config")
+	fs.StringVar(&f.ConfigMapName, "config-name", DefaultConfigMapName, "name of the ConfigMap containing the cluster-wide upgrade config")
+
+	fs.Var(&boolFlag{path: "enabled", values: f.values}, "enabled", "enable the upgrade of the extension")
+	fs.Var(&boolFlag{path: "installCrds", values: f.values}, "install-crds", "force installation of CRDs when the extension is first installed")
+	fs.Var(&boolFlag{path: "upgradeCrds", values: f.values}, "upgrade-crds", "force upgrade of CRDs when the extension version is upgraded")
+	fs.Var(&boolFlag{path: "mergeValues", values: f.values}, "merge-values", "merge values when the extension version is upgraded")
+	fs.Var(&stringFlag{path: "failurePolicy", values: f.values, parse: parseFailurePolicy}, "failure-policy", "policy to use when an error occurs (IgnoreError, FailOnError)")
+	fs.Var(&stringFlag{path: "ownershipConflictPolicy", values: f.values}, "ownership-conflict-policy", "how to handle resources not owned by the release (Report, Adopt, Fail, Ignore)")
+	fs.Var(&setFlag{values: f.values}, "set", "set a config field by path, e.g. dynamicOptions.installWhizardMonitoringPro=true (can be repeated)")
+}
+
+// Layer returns the configuration layer of the flags.
+func (f *Flags) Layer() Layer {
+	return Layer{Source: SourceFlags, Values: f.values}
+}
+
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *stringSliceFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+type boolFlag struct {
+	path   string
+	values map[string]interface{}
+}
+
+func (f *boolFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	if v, ok := lookup(f.values, f.path); ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (f *boolFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	return setValue(f.values, f.path, v)
+}
+
+func (f *boolFlag) IsBoolFlag() bool { return true }
+
+type stringFlag struct {
+	path   string
+	values map[string]interface{}
+	parse  func(string) (interface{}, error)
+}
+
+func (f *stringFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	if v, ok := lookup(f.values, f.path); ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (f *stringFlag) Set(s string) error {
+	if f.parse == nil {
+		return setValue(f.values, f.path, s)
+	}
+	v, err := f.parse(s)
+	if err != nil {
+		return err
+	}
+	return setValue(f.values, f.path, v)
+}
+
+// setFlag sets a field by path, the value is parsed as YAML.
+type setFlag struct {
+	values map[string]interface{}
+}
+
+func (f *setFlag) String() string { return "" }
+
+func (f *setFlag) Set(s string) error {
+	path, raw, ok := strings.Cut(s, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("expected path=value, got %q", s)
+	}
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(raw), &v); err != nil {
+		return fmt.Errorf("invalid value of %s: %v", path, err)
+	}
+	return setValue(f.values, path, v)
+}
+
+func parseFailurePolicy(s string) (interface{}, error) {
+	policy, err := ParseFailurePolicy(s)
+	if err != nil {
+		return nil, err
+	}
+	return policy.String(), nil
+}
+
+func setValue(values map[string]interface{}, path string, v interface{}) error {
+	keys := strings.Split(path, ".")
+	for i, key := range keys[:len(keys)-1] {
+		next, ok := values[key]
+		if !ok {
+			next = make(map[string]interface{})
+			values[key] = next
+		}
+		table, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not a map", strings.Join(keys[:i+1], "."))
+		}
+		values = table
+	}
+	values[keys[len(keys)-1]] = v
+	return nil
+}
+
+func lookup(values map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		table, ok := values[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		values = table
+	}
+	v, ok := values[keys[len(keys)-1]]
+	return v, ok
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
+)
+
+const (
+	SourceDefaults    = "defaults"
+	SourceFile        = "file"
+	SourceConfigMap   = "configmap"
+	SourceChartValues = "values"
+	SourceInstallPlan = "installplan"
+	SourceFlags       = "flags"
+
+	// DefaultConfigMapNamespace and DefaultConfigMapName locate the cluster-wide configuration,
+	// the ConfigMap contains a Config in the ConfigMapKey.
+	DefaultConfigMapNamespace = "kubesphere-system"
+	DefaultConfigMapName      = "ks-extension-upgrade-config"
+	ConfigMapKey              = "config.yaml"
+
+	// DefaultConfigFile is the config file mounted into the executor, e.g. from a ConfigMap or Secret
+	// containing credentials. It contains a Config and is ignored if it does not exist.
+	DefaultConfigFile = "/etc/ks-extension-upgrade/config.yaml"
+
+	// InstallPlanConfigAnnotation contains an ExtensionUpgradeHookConfig overriding the other layers
+	// except flags for a single extension.
+	InstallPlanConfigAnnotation = "upgrade.kubesphere.io/config"
+)
+
+// layerRoots contains the root of the field paths in the validation errors of each source.
+var layerRoots = map[string]string{
+	SourceDefaults:    "defaults",
+	SourceFile:        "file",
+	SourceConfigMap:   ConfigMapKey,
+	SourceChartValues: "global.upgradeConfig",
+	SourceInstallPlan: InstallPlanConfigAnnotation,
+	SourceFlags:       "flags",
+}
+
+// Layer is a partial ExtensionUpgradeHookConfig from a single configuration source.
+type Layer struct {
+	Source string
+	Values map[string]interface{}
+}
+
+// Explanation maps the path of each effective field to the source it came from.
+type Explanation map[string]Origin
+
+// Origin is the source and the value of an effective field.
+type Origin struct {
+	Source string
+	Value  interface{}
+}
+
+// Paths returns the field paths in lexical order.
+func (e Explanation) Paths() []string {
+	paths := make([]string, 0, len(e))
+	for path := range e {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// DefaultsLayer returns the built-in configuration of the extension.
+func DefaultsLayer(extensionName string) (Layer, error) {
+	layer := Layer{Source: SourceDefaults}
+	defaults := NewConfig()
+	cfg := defaults.ExtensionUpgradeHookConfigs[extensionName]
+	if cfg.DownloadOptions == nil {
+		cfg.DownloadOptions = defaults.DownloadOptions
+	}
+	values, err := toValues(cfg)
+	if err != nil {
+		return layer, err
+	}
+	if _, ok := defaults.ExtensionUpgradeHookConfigs[extensionName]; !ok {
+		// only the download options apply to extensions without built-in configuration
+		values = map[string]interface{}{"downloadOptions": values["downloadOptions"]}
+	}
+	layer.Values = values
+	return layer, nil
+}
+
+// FileLayer returns the configuration of the extension from the config file, a missing file results
+// in an empty layer if ignoreMissing is true.
+func FileLayer(path string, extensionName string, ignoreMissing bool) (Layer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if ignoreMissing && errors.Is(err, fs.ErrNotExist) {
+			return Layer{Source: SourceFile}, nil
+		}
+		return Layer{Source: SourceFile}, &InvalidConfigError{Source: SourceFile, Err: err}
+	}
+	return configLayer(SourceFile, path, data, extensionName)
+}
+
+// ConfigMapLayer returns the configuration of the extension from the data of the cluster-wide ConfigMap.
+func ConfigMapLayer(data string, extensionName string) (Layer, error) {
+	return configLayer(SourceConfigMap, ConfigMapKey, []byte(data), extensionName)
+}
+
+// configLayer returns the configuration of the extension from a Config, the top-level download options
+// are the base of the download options of the extension.
+func configLayer(source, name string, data []byte, extensionName string) (Layer, error) {
+	layer := Layer{Source: source}
+	cfg := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return layer, &InvalidConfigError{Source: source, Err: fmt.Errorf("failed to parse %s: %v", name, err)}
+	}
+	if err := validate(configSchema, cfg, name); err != nil {
+		return layer, &InvalidConfigError{Source: source, Err: err}
+	}
+	if err := validateDownloadOptions(cfg["downloadOptions"]); err != nil {
+		return layer, &InvalidConfigError{Source: source, Err: fmt.Errorf("%s.downloadOptions: %v", name, err)}
+	}
+
+	layer.Values = make(map[string]interface{})
+	if downloadOptions, ok := cfg["downloadOptions"]; ok {
+		layer.Values["downloadOptions"] = downloadOptions
+	}
+	if values, err := chartutil.Values(cfg).Table("extensionUpgradeHookConfigs." + extensionName); err == nil {
+		mergeValues(layer.Values, values, "", source, make(Explanation))
+	}
+	return layer, nil
+}
+
+// ValuesLayer returns the configuration from `global.upgradeConfig` of the chart values.
+func ValuesLayer(values chartutil.Values) (Layer, error) {
+	layer := Layer{Source: SourceChartValues}
+	if values == nil {
+		return layer, nil
+	}
+	global, err := values.Table("global")
+	if err != nil {
+		return layer, nil
+	}
+	v, ok := global["upgradeConfig"]
+	if !ok || v == nil {
+		// upgradeConfig is optional
+		return layer, nil
+	}
+	upgradeConfig, err := global.Table("upgradeConfig")
+	if err != nil {
+		return layer, &InvalidConfigError{Source: SourceChartValues, Err: fmt.Errorf("global.upgradeConfig must be a map, got %T", v)}
+	}
+	// convert the values to the JSON representation shared by all layers
+	layer.Values, err = toValues(upgradeConfig)
+	return layer, err
+}
+
+// InstallPlanLayer returns the configuration from the InstallPlanConfigAnnotation of the InstallPlan.
+func InstallPlanLayer(annotation string) (Layer, error) {
+	layer := Layer{Source: SourceInstallPlan}
+	if annotation == "" {
+		return layer, nil
+	}
+	if err := yaml.Unmarshal([]byte(annotation), &layer.Values); err != nil {
+		return layer, &InvalidConfigError{Source: SourceInstallPlan, Err: fmt.Errorf("failed to parse annotation %s: %v", InstallPlanConfigAnnotation, err)}
+	}
+	return layer, nil
+}
+
+// Load validates and merges the layers in order, the fields of later layers override the fields of earlier layers.
+// Maps are merged recursively while other values are replaced, a null value removes the field.
+// An *InvalidConfigError is returned if any layer contains unknown or invalid fields.
+func Load(layers ...Layer) (*ExtensionUpgradeHookConfig, Explanation, error) {
+	merged := make(map[string]interface{})
+	explanation := make(Explanation)
+	for _, layer := range layers {
+		if len(layer.Values) > 0 {
+			root := layerRoots[layer.Source]
+			if err := validate(hookConfigSchema, layer.Values, root); err != nil {
+				return nil, nil, &InvalidConfigError{Source: layer.Source, Err: err}
+			}
+			if err := validateDownloadOptions(layer.Values["downloadOptions"]); err != nil {
+				return nil, nil, &InvalidConfigError{Source: layer.Source, Err: fmt.Errorf("%s.downloadOptions: %v", root, err)}
+			}
+		}
+		mergeValues(merged, layer.Values, "", layer.Source, explanation)
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &ExtensionUpgradeHookConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+	return cfg, explanation, nil
+}
+
+func mergeValues(dst, src map[string]interface{}, prefix, source string, explanation Explanation) {
+	for key, value := range src {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		if table, ok := value.(map[string]interface{}); ok && len(table) > 0 {
+			dstTable, ok := dst[key].(map[string]interface{})
+			if !ok {
+				explanation.remove(path)
+				dstTable = make(map[string]interface{})
+				dst[key] = dstTable
+			}
+			mergeValues(dstTable, table, path, source, explanation)
+			continue
+		}
+
+		explanation.remove(path)
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		dst[key] = value
+		explanation[path] = Origin{Source: source, Value: value}
+	}
+}
+
+// remove removes the path and all paths below it.
+func (e Explanation) remove(path string) {
+	for p := range e {
+		if p == path || strings.HasPrefix(p, path+".") {
+			delete(e, p)
+		}
+	}
+}
+
+func toValues(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// validateDownloadOptions rejects the unknown fields of the download options, which are validated by
+// decoding instead of a schema since they are owned by the download package.
+func validateDownloadOptions(values interface{}) error {
+	if values == nil {
+		return nil
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(&download.Options{})
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
+)
+
+func TestLoad(t *testing.T) {
+	defaults, err := DefaultsLayer("whizard-monitoring")
+	require.NoError(t, err)
+
+	configMap, err := ConfigMapLayer(`
+downloadOptions:
+  globalRegistryUrl: oci://registry.local/charts
+extensionUpgradeHookConfigs:
+  whizard-monitoring:
+    mergeValues: true
+    dynamicOptions:
+      installWhizardMonitoringPro: true
+      renameValues:
+        - from: a
+          to: b
+  devops:
+    enabled: false
+`, "whizard-monitoring")
+	require.NoError(t, err)
+
+	values, err := ValuesLayer(chartutil.Values{
+		"global": map[string]interface{}{
+			"upgradeConfig": map[string]interface{}{
+				"upgradeCrds":    false,
+				"dynamicOptions": map[string]interface{}{"renameValues": []interface{}{}},
+				"downloadOptions": map[string]interface{}{
+					"http": map[string]interface{}{"insecureSkipVerify": false, "caFile": "/etc/ca.pem"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	installPlan, err := InstallPlanLayer(`{"installCrds": null, "ownershipConflictPolicy": "Adopt"}`)
+	require.NoError(t, err)
+
+	flags := NewFlags()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.AddFlags(fs)
+	require.NoError(t, fs.Parse([]string{"--failure-policy=1", "--set", "dynamicOptions.installWhizardMonitoringPro=false"}))
+
+	cfg, explanation, err := Load(defaults, configMap, values, installPlan, flags.Layer())
+	require.NoError(t, err)
+
+	assert.Equal(t, &ExtensionUpgradeHookConfig{
+		Enabled:                 true,
+		InstallCrds:             false,
+		UpgradeCrds:             false,
+		MergeValues:             true,
+		FailurePolicy:           FailOnError,
+		OwnershipConflictPolicy: AdoptConflicts,
+		DynamicOptions: DynamicOptions{
+			"installWhizardMonitoringPro": false,
+			"renameValues":                []interface{}{},
+		},
+		DownloadOptions: &download.Options{
+			GlobalRegistryUrl: "oci://registry.local/charts",
+			HttpOptions:       &download.HttpDownloaderOptions{Timeout: 30, CaFile: "/etc/ca.pem"},
+		},
+	}, cfg)
+
+	sources := make(map[string]string)
+	for path, origin := range explanation {
+		sources[path] = origin.Source
+	}
+	assert.Equal(t, map[string]string{
+		"enabled":                     SourceDefaults,
+		"mergeValues":                 SourceConfigMap,
+		"upgradeCrds":                 SourceChartValues,
+		"dynamicOptions.renameValues": SourceChartValues,
+		"ownershipConflictPolicy":     SourceInstallPlan,
+		"failurePolicy":               SourceFlags,
+		"dynamicOptions.installWhizardMonitoringPro": SourceFlags,
+		"downloadOptions.globalRegistryUrl":          SourceConfigMap,
+		"downloadOptions.http.timeout":               SourceDefaults,
+		"downloadOptions.http.insecureSkipVerify":    SourceChartValues,
+		"downloadOptions.http.caFile":                SourceChartValues,
+	}, sources)
+	assert.Equal(t, []string{
+		"downloadOptions.globalRegistryUrl",
+		"downloadOptions.http.caFile",
+		"downloadOptions.http.insecureSkipVerify",
+		"downloadOptions.http.timeout",
+		"dynamicOptions.installWhizardMonitoringPro",
+		"dynamicOptions.renameValues",
+		"enabled",
+		"failurePolicy",
+		"mergeValues",
+		"ownershipConflictPolicy",
+		"upgradeCrds",
+	}, explanation.Paths())
+}
+
+func TestLoadWithoutLayers(t *testing.T) {
+	defaults, err := DefaultsLayer("unknown")
+	require.NoError(t, err)
+	values, err := ValuesLayer(chartutil.Values{})
+	require.NoError(t, err)
+
+	cfg, explanation, err := Load(defaults, values, NewFlags().Layer())
+	require.NoError(t, err)
+	assert.False(t, cfg.Enabled)
+	assert.Equal(t, NewConfig().DownloadOptions, cfg.DownloadOptions)
+	for _, origin := range explanation {
+		assert.Equal(t, SourceDefaults, origin.Source)
+	}
+}
+
+func TestFileLayer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+downloadOptions:
+  globalRegistryUrl: https://charts.local
+  http:
+    timeout: 60
+extensionUpgradeHookConfigs:
+  devops:
+    enabled: true
+    downloadOptions:
+      http:
+        caFile: /etc/ca.pem
+`), 0644))
+
+	layer, err := FileLayer(path, "devops", false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"enabled": true,
+		"downloadOptions": map[string]interface{}{
+			"globalRegistryUrl": "https://charts.local",
+			"http":              map[string]interface{}{"timeout": float64(60), "caFile": "/etc/ca.pem"},
+		},
+	}, layer.Values)
+
+	layer, err = FileLayer(filepath.Join(t.TempDir(), "missing.yaml"), "devops", true)
+	require.NoError(t, err)
+	assert.Empty(t, layer.Values)
+
+	_, err = FileLayer(filepath.Join(t.TempDir(), "missing.yaml"), "devops", false)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+downloadOptions:
+  http:
+    caFil: /etc/ca.pem
+`), 0644))
+	_, err = FileLayer(path, "devops", false)
+	var invalidConfigErr *InvalidConfigError
+	require.ErrorAs(t, err, &invalidConfigErr)
+	assert.Contains(t, err.Error(), "caFil")
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		layer  func() (Layer, error)
+		source string
+		err    string
+	}{
+		{
+			name: "unknown key in values",
+			layer: func() (Layer, error) {
+				return ValuesLayer(chartutil.Values{"global": map[string]interface{}{
+					"upgradeConfig": map[string]interface{}{"upgradeCRDs": true},
+				}})
+			},
+			source: SourceChartValues,
+			err:    "global.upgradeConfig: Additional property upgradeCRDs is not allowed",
+		},
+		{
+			name: "upgradeConfig is not a map",
+			layer: func() (Layer, error) {
+				return ValuesLayer(chartutil.Values{"global": map[string]interface{}{"upgradeConfig": true}})
+			},
+			source: SourceChartValues,
+			err:    "global.upgradeConfig must be a map",
+		},
+		{
+			name: "unknown failure policy",
+			layer: func() (Layer, error) {
+				return InstallPlanLayer(`failurePolicy: Retry`)
+			},
+			source: SourceInstallPlan,
+			err:    "upgrade.kubesphere.io/config.failurePolicy: failurePolicy must be one of the following",
+		},
+		{
+			name: "unknown key in configmap",
+			layer: func() (Layer, error) {
+				return ConfigMapLayer(`
+extensionUpgradeHookConfigs:
+  whizard-monitoring:
+    enable: true
+`, "whizard-monitoring")
+			},
+			source: SourceConfigMap,
+			err:    "config.yaml.extensionUpgradeHookConfigs.whizard-monitoring: Additional property enable is not allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layer, err := tt.layer()
+			if err == nil {
+				_, _, err = Load(layer)
+			}
+			var invalidConfigErr *InvalidConfigError
+			require.ErrorAs(t, err, &invalidConfigErr)
+			assert.Equal(t, tt.source, invalidConfigErr.Source)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	for _, value := range []string{`"FailOnError"`, `1`} {
+		cfg := &ExtensionUpgradeHookConfig{}
+		require.NoError(t, json.Unmarshal([]byte(`{"failurePolicy": `+value+`}`), cfg))
+		assert.Equal(t, FailOnError, cfg.FailurePolicy)
+	}
+
+	cfg := &ExtensionUpgradeHookConfig{}
+	assert.Error(t, json.Unmarshal([]byte(`{"failurePolicy": 2}`), cfg))
+
+	data, err := json.Marshal(ExtensionUpgradeHookConfig{FailurePolicy: FailOnError})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"failurePolicy":"FailOnError"`)
+}
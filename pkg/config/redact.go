@@ -0,0 +1,67 @@
+package config
+
+import (
+	"strings"
+)
+
+// redactedValue replaces the sensitive values, the same as url.URL.Redacted.
+const redactedValue = "xxxxx"
+
+// sensitiveFields are the keys of the credentials in the download options.
+var sensitiveFields = map[string]bool{
+	"password":         true,
+	"bearerToken":      true,
+	"dockerConfigJson": true,
+	"secretAccessKey":  true,
+	"sessionToken":     true,
+}
+
+// Redact returns a copy of the config with the credentials masked, which should be used whenever the
+// config is logged or printed.
+func Redact(v interface{}) (map[string]interface{}, error) {
+	values, err := toValues(v)
+	if err != nil {
+		return nil, err
+	}
+	return redactValues(values), nil
+}
+
+func redactValues(values map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if sensitiveFields[key] && value != nil && value != "" {
+			redacted[key] = redactedValue
+			continue
+		}
+		redacted[key] = redactValue(value)
+	}
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return redactValues(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = redactValue(item)
+		}
+		return list
+	default:
+		return value
+	}
+}
+
+// Redacted returns a copy of the explanation with the values of the credentials masked.
+func (e Explanation) Redacted() Explanation {
+	redacted := make(Explanation, len(e))
+	for path, origin := range e {
+		field := path[strings.LastIndex(path, ".")+1:]
+		if sensitiveFields[field] && origin.Value != nil && origin.Value != "" {
+			origin.Value = redactedValue
+		}
+		redacted[path] = origin
+	}
+	return redacted
+}
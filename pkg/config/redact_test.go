@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
+)
+
+func TestRedact(t *testing.T) {
+	values, err := Redact(&ExtensionUpgradeHookConfig{
+		Enabled: true,
+		DownloadOptions: &download.Options{
+			HttpOptions: &download.HttpDownloaderOptions{Hosts: map[string]download.HttpHostOptions{
+				"charts.local": {Username: "admin", Password: "secret"},
+				"charts.test":  {BearerToken: "token"},
+			}},
+			OCIOptions: &download.OCIDownloaderOptions{DockerConfigJSON: `{"auths": {}}`},
+			S3Options:  &download.S3DownloaderOptions{AccessKeyID: "minio", SecretAccessKey: "secret"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"http": map[string]interface{}{
+			"hosts": map[string]interface{}{
+				"charts.local": map[string]interface{}{"username": "admin", "password": "xxxxx"},
+				"charts.test":  map[string]interface{}{"bearerToken": "xxxxx"},
+			},
+		},
+		"oci":               map[string]interface{}{"dockerConfigJson": "xxxxx"},
+		"s3":                map[string]interface{}{"accessKeyID": "minio", "secretAccessKey": "xxxxx"},
+		"globalRegistryUrl": "",
+		"file":              nil,
+	}, values["downloadOptions"])
+
+	explanation := Explanation{
+		"downloadOptions.oci.password": {Source: SourceFile, Value: "secret"},
+		"downloadOptions.oci.username": {Source: SourceFile, Value: "admin"},
+	}.Redacted()
+	assert.Equal(t, "xxxxx", explanation["downloadOptions.oci.password"].Value)
+	assert.Equal(t, "admin", explanation["downloadOptions.oci.username"].Value)
+}
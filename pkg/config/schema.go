@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// hookConfigSchema is the JSON schema of ExtensionUpgradeHookConfig, it rejects unknown keys so that typos
+// like `upgradeCRDs` are not ignored silently. Null is allowed since it removes the field of lower layers.
+const hookConfigSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "enabled": {"type": ["boolean", "null"]},
+    "installCrds": {"type": ["boolean", "null"]},
+    "upgradeCrds": {"type": ["boolean", "null"]},
+    "mergeValues": {"type": ["boolean", "null"]},
+    "failurePolicy": {"enum": ["IgnoreError", "FailOnError", 0, 1, null]},
+    "ownershipConflictPolicy": {"enum": ["", "Report", "Adopt", "Fail", "Ignore", null]},
+    "dynamicOptions": {"type": ["object", "null"]},
+    "downloadOptions": {"type": ["object", "null"]}
+  }
+}`
+
+// configSchema is the JSON schema of Config.
+const configSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "downloadOptions": {"type": ["object", "null"]},
+    "extensionUpgradeHookConfigs": {
+      "type": ["object", "null"],
+      "additionalProperties": ` + hookConfigSchema + `
+    }
+  }
+}`
+
+// InvalidConfigError is returned when a configuration source contains an invalid config.
+type InvalidConfigError struct {
+	Source string
+	Err    error
+}
+
+func (e *InvalidConfigError) Error() string {
+	return fmt.Sprintf("invalid upgrade config from %s: %v", e.Source, e.Err)
+}
+
+func (e *InvalidConfigError) Unwrap() error {
+	return e.Err
+}
+
+// validate validates the values against the schema, the errors contain the path of the invalid fields
+// relative to root.
+func validate(schema string, values interface{}, root string) error {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(schema), gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	var errs []string
+	for _, e := range result.Errors() {
+		field := root
+		if e.Field() != gojsonschema.STRING_CONTEXT_ROOT {
+			field += "." + e.Field()
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", field, e.Description()))
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 
 	"helm.sh/helm/v3/pkg/chart"
@@ -10,29 +11,39 @@ import (
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 	kscorev1alpha1 "kubesphere.io/api/core/v1alpha1"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 	restconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 
 	"github.com/kubesphere-extensions/upgrade/pkg/config"
+	"github.com/kubesphere-extensions/upgrade/pkg/extension"
 	"github.com/kubesphere-extensions/upgrade/pkg/hooks"
 	_ "github.com/kubesphere-extensions/upgrade/pkg/hooks/devops"
+	"github.com/kubesphere-extensions/upgrade/pkg/hooks/plugin"
 	_ "github.com/kubesphere-extensions/upgrade/pkg/hooks/whizard-monitoring"
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
 )
 
 type CoreHelper struct {
 	extensionName string
 	isExtension   bool
 	cfg           *config.ExtensionUpgradeHookConfig
+	explanation   config.Explanation
 	chart         *chart.Chart
+	env           *hooks.Environment
+
+	chartDownloader *download.ChartDownloader
+	chartResolver   *extension.ChartResolver
 
 	client        runtimeclient.Client
 	scheme        *runtime.Scheme
 	dynamicClient *dynamic.DynamicClient
+	restConfig    *rest.Config
 }
 
-func NewCoreHelper() (*CoreHelper, error) {
+func NewCoreHelper(ctx context.Context, flags *config.Flags) (*CoreHelper, error) {
 	restConfig, err := restconfig.GetConfig()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get rest config: %s", err)
@@ -62,32 +73,101 @@ func NewCoreHelper() (*CoreHelper, error) {
 	c := &CoreHelper{
 		extensionName: extensionName,
 		isExtension:   isExtension,
+		env: &hooks.Environment{
+			ExtensionName:    extensionName,
+			ReleaseName:      config.GetHookEnvReleaseName(),
+			ReleaseNamespace: config.GetHookEnvReleaseNamespace(),
+			Action:           config.GetHookEnvAction(),
+			Agent:            !isExtension,
+			ClusterRole:      config.GetHookEnvClusterRole(),
+			ClusterName:      config.GetHookEnvClusterName(),
+		},
 		dynamicClient: dynamicClient,
 		client:        client,
 		scheme:        scheme,
+		restConfig:    restConfig,
 	}
 
-	chart, err := loadChart(config.GetHookEnvChartPath(), "values.yaml")
+	if flags == nil {
+		flags = config.NewFlags()
+	}
+	// the chart values are a configuration layer as well, so the chart is loaded with the download options
+	// of the layers not depending on the chart, i.e. the cluster layers and the flags
+	layers, err := c.clusterConfigLayers(ctx, flags)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load chart: %s", err)
+		c.recordEvent(ctx, corev1.EventTypeWarning, ReasonInvalidConfig, err.Error())
+		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
-	cfg, err := config.LoadConfigFromHelmValues(chart.Values)
+	clusterCfg, clusterExplanation, err := config.Load(append(layers[:len(layers):len(layers)], flags.Layer())...)
 	if err != nil {
-		klog.Errorf("failed to load config from helm values: %s", err)
-
-		klog.Info("try to use default config")
-		if defaultCfg, ok := config.NewConfig().ExtensionUpgradeHookConfigs[extensionName]; ok {
-			cfg = &defaultCfg
-		}
+		c.recordEvent(ctx, corev1.EventTypeWarning, ReasonInvalidConfig, err.Error())
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	chartDownloader, err := c.newChartDownloader(ctx, clusterCfg, clusterExplanation)
+	if err != nil {
+		return nil, err
+	}
+	// the resolver backs the `extension://` charts, it is replaced once the effective config is loaded
+	c.chartResolver = extension.NewChartResolver(c.client, chartDownloader)
+	chart, err := loadChart(ctx, chartDownloader, config.GetHookEnvChartPath(), "values.yaml")
+	if err != nil {
+		c.recordVerificationFailure(ctx, err)
+		return nil, fmt.Errorf("failed to load chart: %w", err)
 	}
-
 	c.chart = chart
+
+	layers, err = c.releaseConfigLayers(ctx, layers, flags)
+	if err != nil {
+		c.recordEvent(ctx, corev1.EventTypeWarning, ReasonInvalidConfig, err.Error())
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	cfg, explanation, err := config.Load(layers...)
+	if err != nil {
+		c.recordEvent(ctx, corev1.EventTypeWarning, ReasonInvalidConfig, err.Error())
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
 	c.cfg = cfg
-	klog.Infof("extension %s upgrade config: %+v", c.extensionName, cfg)
+	c.explanation = explanation
+	if redacted, err := config.Redact(cfg); err == nil {
+		klog.Infof("extension %s upgrade config: %v", c.extensionName, redacted)
+	}
+
+	// a single chart downloader configured by the effective config is shared by the core and the hooks,
+	// the cache of the cluster config is shared so that the chart loaded above isn't downloaded again
+	c.chartDownloader, err = c.newChartDownloader(ctx, cfg, explanation, download.WithChartCache(chartDownloader.Cache()))
+	if err != nil {
+		return nil, err
+	}
+	c.chartResolver = extension.NewChartResolver(c.client, c.chartDownloader)
+	c.env.ChartDownloader = c.chartDownloader
+	c.env.ChartResolver = c.chartResolver
 
 	return c, nil
 }
 
+// newChartDownloader creates the chart downloader of the download options of the config, the options which can't
+// be applied, e.g. an invalid mirror pattern or a missing CA file, are an invalid config as well.
+func (c *CoreHelper) newChartDownloader(ctx context.Context, cfg *config.ExtensionUpgradeHookConfig, explanation config.Explanation,
+	opts ...download.ChartDownloaderOption) (*download.ChartDownloader, error) {
+	chartDownloader, err := download.NewChartDownloader(cfg.DownloadOptions, append(c.chartDownloaderOptions(), opts...)...)
+	if err != nil {
+		err = &config.InvalidConfigError{Source: fieldSources(explanation, "downloadOptions"), Err: fmt.Errorf("downloadOptions: %w", err)}
+		c.recordEvent(ctx, corev1.EventTypeWarning, ReasonInvalidConfig, err.Error())
+		return nil, fmt.Errorf("failed to create chart downloader: %w", err)
+	}
+	return chartDownloader, nil
+}
+
+// Config returns the effective upgrade config of the extension.
+func (c *CoreHelper) Config() *config.ExtensionUpgradeHookConfig {
+	return c.cfg
+}
+
+// Explanation returns the source of each field of the effective upgrade config.
+func (c *CoreHelper) Explanation() config.Explanation {
+	return c.explanation
+}
+
 func (c *CoreHelper) Run(ctx context.Context) error {
 
 	if c.cfg == nil || !c.cfg.Enabled {
@@ -116,8 +196,9 @@ func (c *CoreHelper) Run(ctx context.Context) error {
 		klog.Info("crds applied successfully")
 	}
 
+	var installPlan *kscorev1alpha1.InstallPlan
 	if c.isExtension {
-		installPlan := &kscorev1alpha1.InstallPlan{}
+		installPlan = &kscorev1alpha1.InstallPlan{}
 		if err := c.client.Get(ctx, runtimeclient.ObjectKey{Name: c.extensionName}, installPlan); err != nil {
 			return err
 		}
@@ -128,15 +209,34 @@ func (c *CoreHelper) Run(ctx context.Context) error {
 			klog.Info("force merge values before extension version upgrade")
 
 			if err := c.mergeValuesFromExtensionChart(ctx, installPlan); err != nil {
+				c.recordVerificationFailure(ctx, err)
 				return err
 			}
 		}
 
 	}
 
+	// run the migration actions declared in the chart
+	if err := c.runActions(ctx, installPlan); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// CheckOwnershipConflicts detects the resources which would make helm fail to import them into the release.
+// It runs after the hooks, so that the resources adopted by the hooks are not counted as conflicts and the
+// config changed by the plugin hooks is rendered.
+func (c *CoreHelper) CheckOwnershipConflicts(ctx context.Context) error {
+	if c.cfg == nil || !c.cfg.Enabled {
+		return nil
+	}
+	if c.env.Action != config.ActionInstall && c.env.Action != config.ActionUpgrade {
+		return nil
+	}
+	return c.checkOwnershipConflicts(ctx)
+}
+
 func (c *CoreHelper) RunHooks(ctx context.Context) error {
 
 	if c.cfg == nil || !c.cfg.Enabled {
@@ -144,11 +244,107 @@ func (c *CoreHelper) RunHooks(ctx context.Context) error {
 		return nil
 	}
 
-	if hook, ok := hooks.GetHook(c.extensionName); ok {
-		klog.Infof("running hook: %s\n", c.extensionName)
-		if err := hook.Run(ctx, c.client, c.cfg); err != nil {
+	getHook := hooks.GetHook
+	if !c.isExtension {
+		getHook = hooks.GetAgentHook
+	}
+	if hook, ok := getHook(c.extensionName); ok {
+		options, err := hooks.DecodeOptions(hook, c.cfg.DynamicOptions)
+		if err != nil {
+			// the dynamic options not matching the schema of the hook are an invalid config as well
+			err = &config.InvalidConfigError{Source: fieldSources(c.explanation, "dynamicOptions"), Err: err}
+			c.recordEvent(ctx, corev1.EventTypeWarning, ReasonInvalidConfig, err.Error())
+			return fmt.Errorf("failed to run hook %s: %w", c.extensionName, err)
+		}
+		env := *c.env
+		env.Options = options
+
+		klog.Infof("running hook: %s, agent: %t, cluster: %s(%s)\n", c.extensionName, c.env.Agent, c.env.ClusterName, c.env.ClusterRole)
+		if err := hook.Run(ctx, c.client, c.cfg, &env); err != nil {
 			return fmt.Errorf("failed to run hook: %s", err)
 		}
 	}
+
+	if err := c.runPluginHooks(ctx); err != nil {
+		return fmt.Errorf("failed to run plugin hooks: %s", err)
+	}
+	return nil
+}
+
+// fieldSources returns the sources of the effective values of the field, or the field itself if unknown.
+func fieldSources(explanation config.Explanation, field string) string {
+	var sources []string
+	for _, path := range explanation.Paths() {
+		source := explanation[path].Source
+		if (path == field || strings.HasPrefix(path, field+".")) && !slices.Contains(sources, source) {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		return field
+	}
+	return strings.Join(sources, ", ")
+}
+
+// runPluginHooks executes the plugin hooks shipped in the chart under `upgrade/hooks`.
+func (c *CoreHelper) runPluginHooks(ctx context.Context) error {
+	pluginHooks, err := plugin.LoadHooks(c.chart)
+	if err != nil {
+		return err
+	}
+	if len(pluginHooks) == 0 {
+		return nil
+	}
+
+	runner, err := plugin.NewRunner()
+	if err != nil {
+		return err
+	}
+	defer runner.Close()
+
+	var installPlan *kscorev1alpha1.InstallPlan
+	if c.isExtension {
+		installPlan = &kscorev1alpha1.InstallPlan{}
+		if err := c.client.Get(ctx, runtimeclient.ObjectKey{Name: c.extensionName}, installPlan); err != nil {
+			return err
+		}
+	}
+
+	for i := range pluginHooks {
+		hook := &pluginHooks[i]
+		if !hook.Matches(c.env) {
+			continue
+		}
+		req := &plugin.Request{
+			ExtensionName:  c.env.ExtensionName,
+			ReleaseName:    c.env.ReleaseName,
+			Action:         c.env.Action,
+			Agent:          c.env.Agent,
+			ClusterRole:    c.env.ClusterRole,
+			ClusterName:    c.env.ClusterName,
+			DynamicOptions: c.cfg.DynamicOptions,
+		}
+		if installPlan != nil {
+			req.CurrentVersion = installPlan.Status.Version
+			req.TargetVersion = installPlan.Spec.Extension.Version
+			req.Config = installPlan.Spec.Config
+		}
+
+		klog.Infof("running plugin hook: %s\n", hook.Name)
+		resp, err := runner.Run(ctx, hook, req)
+		if err != nil {
+			return err
+		}
+		if resp.Message != "" {
+			klog.Infof("plugin hook %s: %s\n", hook.Name, resp.Message)
+		}
+		if installPlan != nil && resp.Config != "" && resp.Config != installPlan.Spec.Config {
+			patch := runtimeclient.MergeFrom(installPlan.DeepCopy())
+			installPlan.Spec.Config = resp.Config
+			if err := c.client.Patch(ctx, installPlan, patch); err != nil {
+				return fmt.Errorf("failed to patch installPlan config from plugin hook %s: %v", hook.Name, err)
+			}
+		}
+	}
 	return nil
 }
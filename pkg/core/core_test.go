@@ -0,0 +1,269 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	kscorev1alpha1 "kubesphere.io/api/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/adoption"
+	"github.com/kubesphere-extensions/upgrade/pkg/config"
+	"github.com/kubesphere-extensions/upgrade/pkg/hooks"
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
+)
+
+// recordingHook records the environments it runs in.
+type recordingHook struct {
+	envs []hooks.Environment
+}
+
+func (h *recordingHook) Run(_ context.Context, _ client.Client, _ *config.ExtensionUpgradeHookConfig, env *hooks.Environment) error {
+	h.envs = append(h.envs, *env)
+	return nil
+}
+
+func TestRunHooks(t *testing.T) {
+	extensionHook, agentHook := &recordingHook{}, &recordingHook{}
+	hooks.RegisterHook("core-test", extensionHook)
+	hooks.RegisterAgentHook("core-test", agentHook)
+
+	newCoreHelper := func(isExtension bool, env *hooks.Environment) *CoreHelper {
+		return &CoreHelper{
+			extensionName: "core-test",
+			isExtension:   isExtension,
+			cfg:           &config.ExtensionUpgradeHookConfig{Enabled: true},
+			chart:         &chart.Chart{Metadata: &chart.Metadata{Name: "core-test"}},
+			env:           env,
+			client:        fake.NewClientBuilder().Build(),
+		}
+	}
+
+	c := newCoreHelper(true, &hooks.Environment{ExtensionName: "core-test", ReleaseName: "core-test", Action: config.ActionUpgrade})
+	require.NoError(t, c.RunHooks(context.Background()))
+	require.Len(t, extensionHook.envs, 1)
+	assert.Empty(t, agentHook.envs)
+	assert.False(t, extensionHook.envs[0].Agent)
+	assert.True(t, extensionHook.envs[0].IsHostCluster())
+
+	// the agent hook runs for the agent release with the cluster it is deployed to
+	c = newCoreHelper(false, &hooks.Environment{
+		ExtensionName: "core-test",
+		ReleaseName:   "core-test-agent",
+		Action:        config.ActionUpgrade,
+		Agent:         true,
+		ClusterRole:   "member",
+		ClusterName:   "member-1",
+	})
+	require.NoError(t, c.RunHooks(context.Background()))
+	assert.Len(t, extensionHook.envs, 1)
+	require.Len(t, agentHook.envs, 1)
+	env := agentHook.envs[0]
+	assert.True(t, env.Agent)
+	assert.Equal(t, "core-test-agent", env.ReleaseName)
+	assert.Equal(t, "member", env.ClusterRole)
+	assert.Equal(t, "member-1", env.ClusterName)
+	assert.False(t, env.IsHostCluster())
+}
+
+// optionsHook accepts the typed options of replicas.
+type optionsHook struct {
+	recordingHook
+}
+
+type replicasOptions struct {
+	Replicas int `json:"replicas"`
+}
+
+func (h *optionsHook) DefaultOptions() interface{} {
+	return &replicasOptions{Replicas: 1}
+}
+
+func (h *optionsHook) OptionsSchema() string {
+	return `{"type": "object", "properties": {"replicas": {"type": "integer"}}}`
+}
+
+func TestRunHooksInvalidOptions(t *testing.T) {
+	hooks.RegisterHook("core-options", &optionsHook{})
+
+	installPlan := &kscorev1alpha1.InstallPlan{ObjectMeta: metav1.ObjectMeta{Name: "core-options"}}
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	require.NoError(t, kscorev1alpha1.AddToScheme(scheme))
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(installPlan).Build()
+	c := &CoreHelper{
+		extensionName: "core-options",
+		isExtension:   true,
+		cfg: &config.ExtensionUpgradeHookConfig{
+			Enabled:        true,
+			DynamicOptions: config.DynamicOptions{"replicas": "two"},
+		},
+		explanation: config.Explanation{"dynamicOptions.replicas": {Source: config.SourceInstallPlan, Value: "two"}},
+		chart:       &chart.Chart{Metadata: &chart.Metadata{Name: "core-options"}},
+		env:         &hooks.Environment{ExtensionName: "core-options", ReleaseName: "core-options", Action: config.ActionUpgrade},
+		client:      cli,
+	}
+
+	err := c.RunHooks(context.Background())
+	var invalidConfigErr *config.InvalidConfigError
+	require.True(t, errors.As(err, &invalidConfigErr), err)
+	assert.Equal(t, config.SourceInstallPlan, invalidConfigErr.Source)
+	assert.ErrorContains(t, err, "dynamicOptions.replicas")
+
+	events := &corev1.EventList{}
+	require.NoError(t, cli.List(context.Background(), events))
+	require.Len(t, events.Items, 1)
+	assert.Equal(t, ReasonInvalidConfig, events.Items[0].Reason)
+	assert.Equal(t, corev1.EventTypeWarning, events.Items[0].Type)
+}
+
+// adoptingHook takes over the ConfigMaps of the legacy release as the devops hook does.
+type adoptingHook struct{}
+
+func (h *adoptingHook) Run(ctx context.Context, cli client.Client, _ *config.ExtensionUpgradeHookConfig, env *hooks.Environment) error {
+	_, err := adoption.NewAdopter(cli, adoption.Release{Name: env.ReleaseName, Namespace: env.ReleaseNamespace}).
+		WithTakeOver("legacy").
+		Adopt(ctx, []adoption.Selector{{
+			GroupVersionKind: corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+			Namespace:        env.ReleaseNamespace,
+			Names:            []string{env.ExtensionName},
+		}})
+	return err
+}
+
+// newDiscoveryServer serves the discovery of a cluster with the core API only.
+func newDiscoveryServer(t *testing.T) *httptest.Server {
+	responses := map[string]interface{}{
+		"/version": map[string]string{"gitVersion": "v1.28.0", "major": "1", "minor": "28"},
+		"/api":     &metav1.APIVersions{Versions: []string{"v1"}},
+		"/apis":    &metav1.APIGroupList{},
+		"/api/v1": &metav1.APIResourceList{GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"get", "list"}},
+		}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckOwnershipConflictsAfterHooks(t *testing.T) {
+	hooks.RegisterAgentHook("core-conflicts", &adoptingHook{})
+
+	legacy := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "extension-core-conflicts",
+		Name:        "core-conflicts",
+		Labels:      map[string]string{adoption.ManagedByLabel: adoption.ManagedByHelm},
+		Annotations: map[string]string{adoption.ReleaseNameAnnotation: "legacy", adoption.ReleaseNamespaceAnnotation: "extension-core-conflicts"},
+	}}
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	c := &CoreHelper{
+		extensionName: "core-conflicts",
+		cfg:           &config.ExtensionUpgradeHookConfig{Enabled: true, OwnershipConflictPolicy: config.FailOnConflicts},
+		chart: &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "core-conflicts", Version: "1.0.0"},
+			Templates: []*chart.File{{Name: "templates/configmap.yaml", Data: []byte(
+				"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: core-conflicts\n  namespace: extension-core-conflicts\n")}},
+		},
+		env: &hooks.Environment{
+			ExtensionName:    "core-conflicts",
+			ReleaseName:      "core-conflicts-agent",
+			ReleaseNamespace: "extension-core-conflicts",
+			Action:           config.ActionUpgrade,
+			Agent:            true,
+		},
+		client:     fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithObjects(legacy).Build(),
+		restConfig: &rest.Config{Host: newDiscoveryServer(t).URL},
+	}
+
+	err := c.CheckOwnershipConflicts(context.Background())
+	assert.ErrorContains(t, err, "1 resources exist but are not owned by release core-conflicts-agent")
+
+	// the resources adopted by the hooks are not conflicts
+	require.NoError(t, c.RunHooks(context.Background()))
+	assert.NoError(t, c.CheckOwnershipConflicts(context.Background()))
+
+	// the conflicts are only checked for installs and upgrades
+	c.env.Action = config.ActionUninstall
+	assert.NoError(t, c.CheckOwnershipConflicts(context.Background()))
+}
+
+func TestNewChartDownloaderInvalidOptions(t *testing.T) {
+	installPlan := &kscorev1alpha1.InstallPlan{ObjectMeta: metav1.ObjectMeta{Name: "devops"}}
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	require.NoError(t, kscorev1alpha1.AddToScheme(scheme))
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(installPlan).Build()
+	c := &CoreHelper{extensionName: "devops", isExtension: true, client: cli}
+
+	cfg := &config.ExtensionUpgradeHookConfig{DownloadOptions: &download.Options{
+		Mirrors: []download.MirrorRule{{Regex: "(", Mirrors: []string{"https://charts.local/"}}},
+	}}
+	explanation := config.Explanation{"downloadOptions.mirrors": {Source: config.SourceConfigMap}}
+	_, err := c.newChartDownloader(context.Background(), cfg, explanation)
+	var invalidConfigErr *config.InvalidConfigError
+	require.True(t, errors.As(err, &invalidConfigErr), err)
+	assert.Equal(t, config.SourceConfigMap, invalidConfigErr.Source)
+
+	events := &corev1.EventList{}
+	require.NoError(t, cli.List(context.Background(), events))
+	require.Len(t, events.Items, 1)
+	assert.Equal(t, ReasonInvalidConfig, events.Items[0].Reason)
+}
+
+func TestRecordVerificationFailure(t *testing.T) {
+	installPlan := &kscorev1alpha1.InstallPlan{ObjectMeta: metav1.ObjectMeta{Name: "devops"}}
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	require.NoError(t, kscorev1alpha1.AddToScheme(scheme))
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(installPlan).Build()
+	c := &CoreHelper{extensionName: "devops", isExtension: true, client: cli}
+
+	path := filepath.Join(t.TempDir(), "devops-1.2.0.tgz")
+	require.NoError(t, os.WriteFile(path, []byte("devops"), 0o644))
+	chartDownloader, err := download.NewChartDownloader(&download.Options{
+		Verification: &download.VerificationOptions{Digests: map[string]string{path: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))}},
+	})
+	require.NoError(t, err)
+
+	// a missing chart is not a verification failure
+	_, err = loadChart(context.Background(), chartDownloader, filepath.Join(t.TempDir(), "missing.tgz"), "")
+	require.Error(t, err)
+	c.recordVerificationFailure(context.Background(), err)
+	_, err = loadChart(context.Background(), chartDownloader, path, "")
+	require.Error(t, err)
+	c.recordVerificationFailure(context.Background(), fmt.Errorf("failed to load chart: %w", err))
+
+	events := &corev1.EventList{}
+	require.NoError(t, cli.List(context.Background(), events))
+	require.Len(t, events.Items, 1)
+	assert.Equal(t, ReasonChartVerificationFailed, events.Items[0].Reason)
+	assert.Equal(t, corev1.EventTypeWarning, events.Items[0].Type)
+}
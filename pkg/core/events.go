@@ -0,0 +1,71 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	kscorev1alpha1 "kubesphere.io/api/core/v1alpha1"
+	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
+)
+
+const (
+	eventComponent = "ks-extension-upgrade"
+
+	ReasonInvalidConfig           = "InvalidUpgradeConfig"
+	ReasonChartVerificationFailed = "ChartVerificationFailed"
+)
+
+// recordEvent records an event on the InstallPlan of the extension, so that the problem is visible to
+// the users without reading the logs of the hook. It does nothing for agent releases which have no InstallPlan.
+func (c *CoreHelper) recordEvent(ctx context.Context, eventType, reason, message string) {
+	if !c.isExtension {
+		return
+	}
+	installPlan := &kscorev1alpha1.InstallPlan{}
+	if err := c.client.Get(ctx, runtimeclient.ObjectKey{Name: c.extensionName}, installPlan); err != nil {
+		klog.Warningf("failed to get installPlan %s for event %s: %s", c.extensionName, reason, err)
+		return
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// events of cluster-scoped objects live in the default namespace
+			Namespace: metav1.NamespaceDefault,
+			Name:      fmt.Sprintf("%s.%x", installPlan.Name, now.UnixNano()),
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      kscorev1alpha1.SchemeGroupVersion.String(),
+			Kind:            "InstallPlan",
+			Name:            installPlan.Name,
+			UID:             installPlan.UID,
+			ResourceVersion: installPlan.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if err := c.client.Create(ctx, event); err != nil {
+		klog.Warningf("failed to record event %s on installPlan %s: %s", reason, c.extensionName, err)
+	}
+}
+
+// recordVerificationFailure records a warning event if the error is caused by a chart failing its verification,
+// which must not be mistaken for a chart being temporarily unavailable.
+func (c *CoreHelper) recordVerificationFailure(ctx context.Context, err error) {
+	var verificationErr *download.VerificationError
+	if errors.As(err, &verificationErr) {
+		c.recordEvent(ctx, corev1.EventTypeWarning, ReasonChartVerificationFailed, err.Error())
+	}
+}
@@ -1,11 +1,12 @@
 package core
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"os"
 
+	"github.com/kubesphere-extensions/upgrade/pkg/actions"
+	"github.com/kubesphere-extensions/upgrade/pkg/adoption"
 	"github.com/kubesphere-extensions/upgrade/pkg/config"
 	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
 	"helm.sh/helm/v3/pkg/chart"
@@ -13,23 +14,21 @@ import (
 	"helm.sh/helm/v3/pkg/chartutil"
 	corev1 "k8s.io/api/core/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
 	"k8s.io/klog/v2"
 	kscorev1alpha1 "kubesphere.io/api/core/v1alpha1"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/yaml"
 )
 
-func loadChart(chartFile string, valuesFile string) (*chart.Chart, error) {
-	chartDownloader, err := download.NewChartDownloader(config.NewConfig().DownloadOptions)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create chart downloader: %v", err)
-	}
-	chartBuf, err := chartDownloader.Download(chartFile)
+func loadChart(ctx context.Context, chartDownloader *download.ChartDownloader, chartFile string, valuesFile string) (*chart.Chart, error) {
+	chartBuf, err := chartDownloader.Download(ctx, chartFile)
 	if err != nil {
 		return nil, err
 	}
@@ -127,47 +126,18 @@ func (c *CoreHelper) applyCRDsFromSubchartsByTag(ctx context.Context, tag string
 
 func (c *CoreHelper) mergeValuesFromExtensionChart(ctx context.Context, installPlan *kscorev1alpha1.InstallPlan) error {
 
-	extensionVersion := &kscorev1alpha1.ExtensionVersion{}
-	extensionVersionName := installPlan.Spec.Extension.Name + "-" + installPlan.Spec.Extension.Version
-	if err := c.client.Get(ctx, runtimeclient.ObjectKey{Name: extensionVersionName}, extensionVersion); err != nil {
-		return err
-	}
-
-	var chartBuf *bytes.Buffer
-	var err error
-
-	if extensionVersion.Spec.ChartURL != "" {
-		chartDownloader, err := download.NewChartDownloader(config.NewConfig().DownloadOptions)
-		if err != nil {
-			return fmt.Errorf("failed to create chart downloader: %v", err)
-		}
-		if chartBuf, err = chartDownloader.Download(extensionVersion.Spec.ChartURL); err != nil {
-			return fmt.Errorf("failed to download chart %s: %v", extensionVersion.Spec.ChartURL, err)
-		}
-	} else if extensionVersion.Spec.ChartDataRef != nil {
-		cm := corev1.ConfigMap{}
-
-		if err := c.client.Get(ctx, types.NamespacedName{Name: extensionVersion.Spec.ChartDataRef.Name, Namespace: extensionVersion.Spec.ChartDataRef.Namespace}, &cm); err != nil {
-			return fmt.Errorf("failed to get configmap %s: %v", cm.Name, err)
-		}
-		chartBytes, ok := cm.BinaryData[extensionVersion.Spec.ChartDataRef.Key]
-		if !ok {
-			return fmt.Errorf("failed to get chart data from configmap %s", cm.Name)
-		}
-		chartBuf = bytes.NewBuffer(chartBytes)
-	}
-
-	extensionChart, err := loader.LoadArchive(chartBuf)
+	extensionChart, err := c.chartResolver.Resolve(ctx, installPlan.Spec.Extension.Name, installPlan.Spec.Extension.Version)
 	if err != nil {
-		return fmt.Errorf("failed to load chart data: %v", err)
+		return err
 	}
 
-	klog.Infof("installPlan values: %s\n", installPlan.Spec.Config)
-
 	installPlanValues := make(map[string]interface{})
 	if err := yaml.Unmarshal([]byte(installPlan.Spec.Config), &installPlanValues); err != nil {
 		return fmt.Errorf("failed to unmarshal installPlan config: %v", err)
 	}
+	if redacted, err := config.Redact(installPlanValues); err == nil {
+		klog.Infof("installPlan values: %v\n", redacted)
+	}
 
 	// Set the dependency to empty to avoid introducing subchart values
 	extensionChart.SetDependencies()
@@ -180,7 +150,10 @@ func (c *CoreHelper) mergeValuesFromExtensionChart(ctx context.Context, installP
 		return fmt.Errorf("failed to marshal merged values: %v", err)
 	}
 
-	klog.Infof("merged values: %s\n", mergedValues)
+	// the values may contain credentials, e.g. of the registries, which are redacted in the log
+	if redacted, err := config.Redact(map[string]interface{}(values)); err == nil {
+		klog.Infof("merged values: %v", redacted)
+	}
 	installPlan.Spec.Config = string(mergedValues)
 
 	err = c.client.Update(ctx, installPlan, &runtimeclient.UpdateOptions{})
@@ -189,3 +162,250 @@ func (c *CoreHelper) mergeValuesFromExtensionChart(ctx context.Context, installP
 	}
 	return nil
 }
+
+// runActions executes the declarative actions shipped in the chart, installPlan is nil for agent releases.
+func (c *CoreHelper) runActions(ctx context.Context, installPlan *kscorev1alpha1.InstallPlan) error {
+	chartActions, err := actions.Load(c.chart)
+	if err != nil {
+		return err
+	}
+	if len(chartActions) == 0 {
+		return nil
+	}
+
+	scope := &actions.Scope{
+		ReleaseName:      c.env.ReleaseName,
+		ReleaseNamespace: c.env.ReleaseNamespace,
+		Action:           c.env.Action,
+		Agent:            c.env.Agent,
+	}
+	if installPlan != nil {
+		scope.CurrentVersion = installPlan.Status.Version
+		scope.TargetVersion = installPlan.Spec.Extension.Version
+	}
+	return actions.NewEngine(c.dynamicClient, c.client.RESTMapper()).Run(ctx, chartActions, scope)
+}
+
+// checkOwnershipConflicts renders the chart with the values of the release and checks the rendered objects
+// against the cluster, the objects existing but not owned by the release are handled by the configured policy.
+func (c *CoreHelper) checkOwnershipConflicts(ctx context.Context) error {
+	policy := c.cfg.OwnershipConflictPolicy
+	if policy == "" {
+		policy = config.ReportConflicts
+	}
+	if policy == config.IgnoreConflicts {
+		return nil
+	}
+
+	report, err := c.detectOwnershipConflicts(ctx, policy == config.AdoptConflicts)
+	if err != nil {
+		if policy == config.FailOnConflicts {
+			return fmt.Errorf("failed to detect ownership conflicts: %v", err)
+		}
+		klog.Warningf("failed to detect ownership conflicts: %v", err)
+		return nil
+	}
+
+	for _, conflict := range report.Conflicts {
+		klog.Warningf("ownership conflict: %s", conflict)
+	}
+	if policy == config.AdoptConflicts {
+		klog.Infof("%d resources adopted into release %s", len(report.Adopted), c.env.ReleaseName)
+		return nil
+	}
+	for _, ref := range report.Adopted {
+		klog.Warningf("ownership conflict: %s exists but is not owned by release %s", ref, c.env.ReleaseName)
+	}
+	if policy == config.FailOnConflicts && (len(report.Adopted) > 0 || len(report.Conflicts) > 0) {
+		return fmt.Errorf("%d resources exist but are not owned by release %s", len(report.Adopted)+len(report.Conflicts), c.env.ReleaseName)
+	}
+	return nil
+}
+
+func (c *CoreHelper) detectOwnershipConflicts(ctx context.Context, adopt bool) (*adoption.Report, error) {
+	caps, err := c.capabilities()
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := c.releaseValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	release := adoption.Release{Name: c.env.ReleaseName, Namespace: c.env.ReleaseNamespace}
+	objs, err := adoption.RenderObjects(c.chart, values, adoption.RenderOptions{
+		Release:      release,
+		IsUpgrade:    c.env.Action == config.ActionUpgrade,
+		Capabilities: caps,
+		RestConfig:   c.restConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return adoption.NewAdopter(c.client, release).WithDryRun(!adopt).AdoptObjects(ctx, objs)
+}
+
+// releaseValues returns the values the release is installed with, i.e. the tags set by the executor and the
+// config of the InstallPlan over the chart values. The InstallPlan is read again since its config may be
+// changed by the earlier steps, e.g. merging values and plugin hooks.
+func (c *CoreHelper) releaseValues(ctx context.Context) (chartutil.Values, error) {
+	values, err := chartutil.ReadValues(nil)
+	if err != nil {
+		return nil, err
+	}
+	// the same tags are set by the executor when installing the release
+	values["tags"] = map[string]interface{}{
+		"extension": c.isExtension,
+		"agent":     !c.isExtension,
+	}
+	if c.isExtension {
+		installPlan := &kscorev1alpha1.InstallPlan{}
+		if err := c.client.Get(ctx, runtimeclient.ObjectKey{Name: c.extensionName}, installPlan); err != nil {
+			return nil, fmt.Errorf("failed to get installPlan %s: %v", c.extensionName, err)
+		}
+		planValues, err := chartutil.ReadValues([]byte(installPlan.Spec.Config))
+		if err != nil {
+			return nil, fmt.Errorf("invalid config of installPlan %s: %v", c.extensionName, err)
+		}
+		values = chartutil.CoalesceTables(values, planValues)
+	}
+	return chartutil.CoalesceTables(values, c.chart.Values), nil
+}
+
+func (c *CoreHelper) capabilities() (*chartutil.Capabilities, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(c.restConfig)
+	if err != nil {
+		return nil, err
+	}
+	kubeVersion, err := discoveryClient.ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server version: %v", err)
+	}
+	groups, resources, err := discoveryClient.ServerGroupsAndResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, fmt.Errorf("failed to get api versions: %v", err)
+	}
+	var apiVersions chartutil.VersionSet
+	for _, group := range groups {
+		for _, gv := range group.Versions {
+			apiVersions = append(apiVersions, gv.GroupVersion)
+		}
+	}
+	for _, resourceList := range resources {
+		for _, resource := range resourceList.APIResources {
+			apiVersions = append(apiVersions, resourceList.GroupVersion+"/"+resource.Kind)
+		}
+	}
+	return &chartutil.Capabilities{
+		APIVersions: apiVersions,
+		KubeVersion: chartutil.KubeVersion{
+			Version: kubeVersion.GitVersion,
+			Major:   kubeVersion.Major,
+			Minor:   kubeVersion.Minor,
+		},
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}, nil
+}
+
+// getSecret returns the data of the Secret referred by the download options.
+func (c *CoreHelper) getSecret(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	secret := &corev1.Secret{}
+	if err := c.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret); err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+func (c *CoreHelper) getConfigMap(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+	cm := &corev1.ConfigMap{}
+	if err := c.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, cm); err != nil {
+		return nil, err
+	}
+	data := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for key, value := range cm.Data {
+		data[key] = []byte(value)
+	}
+	for key, value := range cm.BinaryData {
+		data[key] = value
+	}
+	return data, nil
+}
+
+// getExtensionChart returns the chart archive of the extension version by the current chart resolver.
+func (c *CoreHelper) getExtensionChart(ctx context.Context, name, version string) ([]byte, error) {
+	return c.chartResolver.Archive(ctx, name, version)
+}
+
+// chartDownloaderOptions returns the options giving the chart downloaders access to the in-cluster charts.
+func (c *CoreHelper) chartDownloaderOptions() []download.ChartDownloaderOption {
+	return []download.ChartDownloaderOption{
+		download.WithSecretGetter(c.getSecret),
+		download.WithConfigMapGetter(c.getConfigMap),
+		download.WithExtensionChartGetter(c.getExtensionChart),
+	}
+}
+
+// clusterConfigLayers returns the configuration layers which do not depend on the release, in order of
+// precedence from lowest to highest: built-in defaults, config files and the cluster-wide ConfigMap.
+// Sources that can not be read are skipped, while invalid sources fail the loading.
+func (c *CoreHelper) clusterConfigLayers(ctx context.Context, flags *config.Flags) ([]config.Layer, error) {
+	defaults, err := config.DefaultsLayer(c.extensionName)
+	if err != nil {
+		return nil, err
+	}
+	layers := []config.Layer{defaults}
+
+	configFiles, ignoreMissing := flags.ConfigFiles, false
+	if len(configFiles) == 0 {
+		configFiles, ignoreMissing = []string{config.DefaultConfigFile}, true
+	}
+	for _, configFile := range configFiles {
+		layer, err := config.FileLayer(configFile, c.extensionName, ignoreMissing)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := c.client.Get(ctx, types.NamespacedName{Namespace: flags.ConfigMapNamespace, Name: flags.ConfigMapName}, cm); err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.Warningf("failed to get config from configmap %s/%s: %s", flags.ConfigMapNamespace, flags.ConfigMapName, err)
+		}
+	} else {
+		layer, err := config.ConfigMapLayer(cm.Data[config.ConfigMapKey], c.extensionName)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// releaseConfigLayers appends the configuration layers of the release to the cluster layers, in order of
+// precedence from lowest to highest: chart values, InstallPlan annotation and flags.
+func (c *CoreHelper) releaseConfigLayers(ctx context.Context, layers []config.Layer, flags *config.Flags) ([]config.Layer, error) {
+	layer, err := config.ValuesLayer(c.chart.Values)
+	if err != nil {
+		return nil, err
+	}
+	layers = append(layers, layer)
+
+	if c.isExtension {
+		installPlan := &kscorev1alpha1.InstallPlan{}
+		if err := c.client.Get(ctx, runtimeclient.ObjectKey{Name: c.extensionName}, installPlan); err != nil {
+			if !apierrors.IsNotFound(err) {
+				klog.Warningf("failed to get installPlan %s: %s", c.extensionName, err)
+			}
+		} else {
+			layer, err := config.InstallPlanLayer(installPlan.Annotations[config.InstallPlanConfigAnnotation])
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+		}
+	}
+
+	return append(layers, flags.Layer()), nil
+}
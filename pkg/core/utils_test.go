@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kscorev1alpha1 "kubesphere.io/api/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/adoption"
+)
+
+func TestReleaseValues(t *testing.T) {
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "devops", Version: "1.2.4"},
+		Values:   map[string]interface{}{"ingress": map[string]interface{}{"enabled": false, "name": "devops"}},
+		Templates: []*chart.File{{Name: "templates/ingress.yaml", Data: []byte(
+			"{{- if .Values.ingress.enabled }}\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Values.ingress.name }}\n{{- end }}\n")}},
+	}
+	installPlan := &kscorev1alpha1.InstallPlan{
+		ObjectMeta: metav1.ObjectMeta{Name: "devops"},
+		Spec:       kscorev1alpha1.InstallPlanSpec{Config: "ingress:\n  enabled: true\n"},
+	}
+	scheme := runtime.NewScheme()
+	require.NoError(t, kscorev1alpha1.AddToScheme(scheme))
+	c := &CoreHelper{
+		extensionName: "devops",
+		isExtension:   true,
+		chart:         ch,
+		client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(installPlan).Build(),
+	}
+
+	values, err := c.releaseValues(context.Background())
+	require.NoError(t, err)
+	objs, err := adoption.RenderObjects(ch, values, adoption.RenderOptions{
+		Release: adoption.Release{Name: "devops", Namespace: "extension-devops"},
+	})
+	require.NoError(t, err)
+	// the template is only rendered with the config of the InstallPlan
+	require.Len(t, objs, 1)
+	assert.Equal(t, "devops", objs[0].GetName())
+
+	// the agent releases have no InstallPlan in their clusters
+	c.isExtension = false
+	values, err = c.releaseValues(context.Background())
+	require.NoError(t, err)
+	objs, err = adoption.RenderObjects(ch, values, adoption.RenderOptions{
+		Release: adoption.Release{Name: "devops-agent", Namespace: "extension-devops"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, objs)
+}
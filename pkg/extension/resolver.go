@@ -0,0 +1,197 @@
+package extension
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kscorev1alpha1 "kubesphere.io/api/core/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
+)
+
+// ExtensionVersionName returns the name of the ExtensionVersion of the extension.
+func ExtensionVersionName(name, version string) string {
+	return name + "-" + version
+}
+
+// ChartDigestAnnotation is the annotation of the ExtensionVersion holding the expected SHA-256 digest of
+// its chart archive, e.g. `sha256:<hex>`.
+const ChartDigestAnnotation = "upgrade.kubesphere.io/chart-digest"
+
+// ChartResolver resolves the chart of an extension version from its ExtensionVersion, which refers to
+// the chart by URL, optionally relative to the URL of its Repository, or by ConfigMap.
+// The chart archives are cached, each call returns a newly loaded chart which can be modified freely.
+type ChartResolver struct {
+	client     client.Client
+	downloader *download.ChartDownloader
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+func NewChartResolver(cli client.Client, downloader *download.ChartDownloader) *ChartResolver {
+	return &ChartResolver{
+		client:     cli,
+		downloader: downloader,
+		cache:      make(map[string][]byte),
+	}
+}
+
+// Resolve returns the chart of the given extension version.
+func (r *ChartResolver) Resolve(ctx context.Context, name, version string) (*chart.Chart, error) {
+	extensionVersion := &kscorev1alpha1.ExtensionVersion{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: ExtensionVersionName(name, version)}, extensionVersion); err != nil {
+		return nil, fmt.Errorf("failed to get extensionVersion %s: %v", ExtensionVersionName(name, version), err)
+	}
+	return r.ResolveExtensionVersion(ctx, extensionVersion)
+}
+
+// Archive returns the chart archive of the given extension version, which backs `extension://` chart URIs.
+func (r *ChartResolver) Archive(ctx context.Context, name, version string) ([]byte, error) {
+	extensionVersion := &kscorev1alpha1.ExtensionVersion{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: ExtensionVersionName(name, version)}, extensionVersion); err != nil {
+		return nil, fmt.Errorf("failed to get extensionVersion %s: %v", ExtensionVersionName(name, version), err)
+	}
+	return r.archive(ctx, extensionVersion)
+}
+
+// ResolveExtensionVersion returns the chart the ExtensionVersion refers to.
+func (r *ChartResolver) ResolveExtensionVersion(ctx context.Context, extensionVersion *kscorev1alpha1.ExtensionVersion) (*chart.Chart, error) {
+	data, err := r.archive(ctx, extensionVersion)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chart of extensionVersion %s: %v", extensionVersion.Name, err)
+	}
+	return ch, nil
+}
+
+func (r *ChartResolver) archive(ctx context.Context, extensionVersion *kscorev1alpha1.ExtensionVersion) ([]byte, error) {
+	key := string(extensionVersion.UID) + "/" + extensionVersion.Name + "@" + extensionVersion.ResourceVersion
+	r.mu.Lock()
+	data, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	var err error
+	spec := extensionVersion.Spec
+	switch {
+	case spec.ChartURL != "":
+		data, err = r.download(ctx, extensionVersion)
+	case spec.ChartDataRef != nil:
+		data, err = r.readChartData(ctx, spec.ChartDataRef)
+	default:
+		return nil, fmt.Errorf("extensionVersion %s has neither chartURL nor chartDataRef", extensionVersion.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chart of extensionVersion %s: %w", extensionVersion.Name, err)
+	}
+	if digest := extensionVersion.Annotations[ChartDigestAnnotation]; digest != "" {
+		if err := download.VerifyDigest(data, digest); err != nil {
+			return nil, &download.VerificationError{Err: fmt.Errorf("failed to verify chart of extensionVersion %s: %v", extensionVersion.Name, err)}
+		}
+	}
+
+	r.mu.Lock()
+	r.cache[key] = data
+	r.mu.Unlock()
+	return data, nil
+}
+
+// download downloads the chart from the chart URL, relative URLs are resolved against the URL of the
+// Repository the ExtensionVersion belongs to, whose credentials and CA are used for its own host.
+// The chart URL can't refer to another ExtensionVersion, which is resolved by the resolver itself and
+// would recurse without bound for an ExtensionVersion referring to itself.
+func (r *ChartResolver) download(ctx context.Context, extensionVersion *kscorev1alpha1.ExtensionVersion) ([]byte, error) {
+	chartURL := extensionVersion.Spec.ChartURL
+	repositoryName := extensionVersion.Labels[kscorev1alpha1.RepositoryReferenceLabel]
+	if repositoryName == "" {
+		if isExtensionURL(chartURL) {
+			return nil, fmt.Errorf("chartURL %s refers to an extensionVersion", download.RedactURL(chartURL))
+		}
+		return r.downloadTo(ctx, chartURL)
+	}
+
+	repository := &kscorev1alpha1.Repository{}
+	if err := r.client.Get(ctx, client.ObjectKey{Name: repositoryName}, repository); err != nil {
+		return nil, fmt.Errorf("failed to get repository %s: %v", repositoryName, err)
+	}
+	u, err := resolveURL(repository.Spec.URL, chartURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve chartURL %s against repository %s: %v", download.RedactURL(chartURL), repositoryName, err)
+	}
+	if isExtensionURL(u.String()) {
+		return nil, fmt.Errorf("chartURL %s refers to an extensionVersion", download.RedactURL(u.String()))
+	}
+
+	repoURL, _ := url.Parse(repository.Spec.URL)
+	if repoURL == nil || repoURL.Host != u.Host || (u.Scheme != "http" && u.Scheme != "https") {
+		return r.downloadTo(ctx, u.String())
+	}
+	// the credentials are passed as host options rather than embedded in the URL, which may be logged
+	hostOptions := download.HttpHostOptions{
+		CaBundle:           repository.Spec.CABundle,
+		InsecureSkipVerify: &repository.Spec.Insecure,
+	}
+	if auth := repository.Spec.BasicAuth; auth != nil && auth.Username != "" {
+		hostOptions.Username, hostOptions.Password = auth.Username, auth.Password
+	}
+	return r.downloadTo(ctx, u.String(), download.WithHostOptions(u.Host, hostOptions))
+}
+
+func (r *ChartResolver) downloadTo(ctx context.Context, uri string, opts ...download.DownloadOption) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := r.downloader.DownloadTo(ctx, uri, buf, opts...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *ChartResolver) readChartData(ctx context.Context, ref *kscorev1alpha1.ConfigMapKeyRef) ([]byte, error) {
+	cm := &corev1.ConfigMap{}
+	if err := r.client.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, cm); err != nil {
+		return nil, fmt.Errorf("failed to get configmap %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	if data, ok := cm.BinaryData[ref.Key]; ok {
+		return data, nil
+	}
+	return nil, fmt.Errorf("key %s not found in binaryData of configmap %s/%s", ref.Key, ref.Namespace, ref.Name)
+}
+
+// isExtensionURL returns whether the URI refers to an ExtensionVersion, i.e. `extension://<name>@<version>`.
+func isExtensionURL(uri string) bool {
+	scheme, _, ok := strings.Cut(uri, "://")
+	return ok && strings.EqualFold(scheme, "extension")
+}
+
+// resolveURL resolves the reference against the base URL, which is treated as a directory.
+func resolveURL(base, ref string) (*url.URL, error) {
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s", download.RedactURL(ref))
+	}
+	if refURL.IsAbs() {
+		return refURL, nil
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(base, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s", download.RedactURL(base))
+	}
+	if baseURL.Scheme == "" {
+		return nil, fmt.Errorf("repository URL %q is not absolute", base)
+	}
+	return baseURL.ResolveReference(refURL), nil
+}
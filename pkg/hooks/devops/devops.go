@@ -4,8 +4,6 @@ import (
 	"context"
 	"fmt"
 
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/version"
@@ -13,6 +11,7 @@ import (
 	kscorev1alpha1 "kubesphere.io/api/core/v1alpha1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/kubesphere-extensions/upgrade/pkg/adoption"
 	"github.com/kubesphere-extensions/upgrade/pkg/config"
 	"github.com/kubesphere-extensions/upgrade/pkg/hooks"
 )
@@ -21,13 +20,17 @@ const (
 	extensionName = "devops"
 )
 
+// legacyOwners are the releases owning the roles before 1.2.4, which moved them from the agent chart into the
+// extension chart.
+var legacyOwners = []string{extensionName + "-agent"}
+
 func init() {
 	hooks.RegisterHook(extensionName, &Hook{})
 }
 
 type Hook struct{}
 
-func (h *Hook) Run(ctx context.Context, c client.Client, _ *config.ExtensionUpgradeHookConfig) error {
+func (h *Hook) Run(ctx context.Context, c client.Client, _ *config.ExtensionUpgradeHookConfig, env *hooks.Environment) error {
 	installPlan := &kscorev1alpha1.InstallPlan{}
 	if err := c.Get(ctx, types.NamespacedName{Name: extensionName}, installPlan); err != nil {
 		return fmt.Errorf("failed to get install plan %s: %v", extensionName, err)
@@ -40,12 +43,16 @@ func (h *Hook) Run(ctx context.Context, c client.Client, _ *config.ExtensionUpgr
 	v124 := version.MustParseSemantic("1.2.4-0")
 	// Upgrade from < 1.2.4 to >= 1.2.4
 	if currentVersion.LessThan(v124) && (expectVersion.GreaterThan(v124) || expectVersion.EqualTo(v124)) {
-		return h.fixConflictResourceMetadata(ctx, c)
+		releaseNamespace := env.ReleaseNamespace
+		if releaseNamespace == "" {
+			releaseNamespace = installPlan.Status.TargetNamespace
+		}
+		return h.fixConflictResourceMetadata(ctx, c, adoption.Release{Name: extensionName, Namespace: releaseNamespace})
 	}
 	return nil
 }
 
-func (h *Hook) fixConflictResourceMetadata(ctx context.Context, c client.Client) error {
+func (h *Hook) fixConflictResourceMetadata(ctx context.Context, c client.Client, release adoption.Release) error {
 	resourceTypes := []struct {
 		kind  string
 		names []string
@@ -55,32 +62,26 @@ func (h *Hook) fixConflictResourceMetadata(ctx context.Context, c client.Client)
 		{"RoleTemplate", []string{"workspace-view-devops", "workspace-create-devops", "workspace-manage-devops"}},
 	}
 
+	var selectors []adoption.Selector
 	for _, resource := range resourceTypes {
-		for _, roleName := range resource.names {
-			u := &unstructured.Unstructured{}
-			u.SetGroupVersionKind(schema.GroupVersionKind{
+		selectors = append(selectors, adoption.Selector{
+			GroupVersionKind: schema.GroupVersionKind{
 				Group:   "iam.kubesphere.io",
 				Version: "v1beta1",
 				Kind:    resource.kind,
-			})
-
-			key := client.ObjectKey{Name: roleName}
-			if err := c.Get(ctx, key, u); err != nil {
-				if errors.IsNotFound(err) {
-					continue
-				}
-				return err
-			}
-
-			annotations := u.GetAnnotations()
-			annotations["meta.helm.sh/release-name"] = "devops"
-			u.SetAnnotations(annotations)
-
-			if err := c.Update(ctx, u); err != nil {
-				return err
-			}
-		}
+			},
+			Names: resource.names,
+		})
 	}
 
+	// the legacy resources carry the markers of the legacy owners, which are rewritten as before the adoption,
+	// the resources owned by other releases are reported
+	report, err := adoption.NewAdopter(c, release).WithTakeOver(legacyOwners...).Adopt(ctx, selectors)
+	if err != nil {
+		return err
+	}
+	for _, conflict := range report.Conflicts {
+		klog.Warningf("devops resource conflict: %s", conflict)
+	}
 	return nil
 }
@@ -0,0 +1,52 @@
+package devops
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/adoption"
+)
+
+func TestFixConflictResourceMetadata(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "iam.kubesphere.io", Version: "v1beta1", Kind: "GlobalRole"}
+	newRole := func(name, owner string) *unstructured.Unstructured {
+		role := &unstructured.Unstructured{}
+		role.SetGroupVersionKind(gvk)
+		role.SetName(name)
+		role.SetAnnotations(map[string]string{
+			adoption.ReleaseNameAnnotation:      owner,
+			adoption.ReleaseNamespaceAnnotation: "kubesphere-devops-system",
+		})
+		return role
+	}
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(gvk, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(gvk.GroupVersion().WithKind("GlobalRoleList"), &unstructured.UnstructuredList{})
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newRole("devops-anonymous", "devops-agent"),
+		newRole("devops-authenticated", "other"),
+	).Build()
+
+	release := adoption.Release{Name: "devops", Namespace: "extension-devops"}
+	require.NoError(t, (&Hook{}).fixConflictResourceMetadata(context.Background(), cli, release))
+
+	got := &unstructured.Unstructured{}
+	got.SetGroupVersionKind(gvk)
+	require.NoError(t, cli.Get(context.Background(), client.ObjectKey{Name: "devops-anonymous"}, got))
+	assert.Equal(t, "devops", got.GetAnnotations()[adoption.ReleaseNameAnnotation])
+	assert.Equal(t, "extension-devops", got.GetAnnotations()[adoption.ReleaseNamespaceAnnotation])
+	assert.Equal(t, adoption.ManagedByHelm, got.GetLabels()[adoption.ManagedByLabel])
+
+	// the roles of other releases are reported rather than taken over
+	require.NoError(t, cli.Get(context.Background(), client.ObjectKey{Name: "devops-authenticated"}, got))
+	assert.Equal(t, "other", got.GetAnnotations()[adoption.ReleaseNameAnnotation])
+	assert.Equal(t, "kubesphere-devops-system", got.GetAnnotations()[adoption.ReleaseNamespaceAnnotation])
+}
@@ -2,18 +2,49 @@ package hooks
 
 import (
 	"context"
+	"sort"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/kubesphere-extensions/upgrade/pkg/config"
+	"github.com/kubesphere-extensions/upgrade/pkg/extension"
+	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
 )
 
 type Hook interface {
-	Run(ctx context.Context, cli client.Client, cfg *config.ExtensionUpgradeHookConfig) error
+	Run(ctx context.Context, cli client.Client, cfg *config.ExtensionUpgradeHookConfig, env *Environment) error
 }
 
-var hookRegistry = make(map[string]Hook)
+// Environment describes the release and cluster a hook is running for.
+type Environment struct {
+	ExtensionName    string
+	ReleaseName      string
+	ReleaseNamespace string
+	Action           string
+	// Agent indicates that the hook is running for the agent release (`<extension>-agent`) of the extension.
+	Agent bool
+	// ClusterRole is the role of the cluster the release is deployed to, empty means host cluster.
+	ClusterRole string
+	ClusterName string
+	// Options contains the typed options decoded from the dynamic options if the hook implements OptionsProvider.
+	Options interface{}
+	// ChartDownloader is configured by the download options of the effective config.
+	ChartDownloader *download.ChartDownloader
+	// ChartResolver resolves the charts of extension versions with ChartDownloader.
+	ChartResolver *extension.ChartResolver
+}
+
+// IsHostCluster returns true if the release is deployed to the host cluster.
+func (e *Environment) IsHostCluster() bool {
+	return e.ClusterRole == "" || e.ClusterRole == config.ClusterRoleHost
+}
+
+var (
+	hookRegistry      = make(map[string]Hook)
+	agentHookRegistry = make(map[string]Hook)
+)
 
+// RegisterHook registers a hook running for the extension release on the host cluster.
 func RegisterHook(name string, hook Hook) {
 	if _, exists := hookRegistry[name]; exists {
 		panic("hook already registered: " + name)
@@ -21,7 +52,46 @@ func RegisterHook(name string, hook Hook) {
 	hookRegistry[name] = hook
 }
 
+// RegisterAgentHook registers a hook running for the agent release of the extension,
+// which may be deployed to the host cluster as well as member clusters.
+func RegisterAgentHook(name string, hook Hook) {
+	if _, exists := agentHookRegistry[name]; exists {
+		panic("agent hook already registered: " + name)
+	}
+	agentHookRegistry[name] = hook
+}
+
 func GetHook(name string) (Hook, bool) {
 	hook, exists := hookRegistry[name]
 	return hook, exists
 }
+
+func GetAgentHook(name string) (Hook, bool) {
+	hook, exists := agentHookRegistry[name]
+	return hook, exists
+}
+
+// Info describes a registered hook.
+type Info struct {
+	Name  string
+	Agent bool
+	Hook  Hook
+}
+
+// List returns all registered hooks sorted by name, the agent hooks follow the extension hooks of the same name.
+func List() []Info {
+	var infos []Info
+	for name, hook := range hookRegistry {
+		infos = append(infos, Info{Name: name, Hook: hook})
+	}
+	for name, hook := range agentHookRegistry {
+		infos = append(infos, Info{Name: name, Agent: true, Hook: hook})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return !infos[i].Agent && infos[j].Agent
+	})
+	return infos
+}
@@ -0,0 +1,62 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/config"
+)
+
+// OptionsProvider is implemented by hooks accepting typed options from
+// ExtensionUpgradeHookConfig.DynamicOptions, the decoded options are passed to the hook in Environment.Options.
+type OptionsProvider interface {
+	// DefaultOptions returns a pointer to a new options struct filled with the default values.
+	DefaultOptions() interface{}
+	// OptionsSchema returns the JSON schema of the options.
+	OptionsSchema() string
+}
+
+// DecodeOptions validates the dynamic options against the schema of the hook and decodes them into the
+// default options of the hook. It returns nil if the hook does not implement OptionsProvider.
+func DecodeOptions(hook Hook, dynamicOptions config.DynamicOptions) (interface{}, error) {
+	provider, ok := hook.(OptionsProvider)
+	if !ok {
+		return nil, nil
+	}
+	options := provider.DefaultOptions()
+	if len(dynamicOptions) == 0 {
+		return options, nil
+	}
+
+	// round trip through JSON to validate the values the same way as they are decoded
+	data, err := json.Marshal(dynamicOptions)
+	if err != nil {
+		return nil, fmt.Errorf("dynamicOptions: %v", err)
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(provider.OptionsSchema()), gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate dynamicOptions: %v", err)
+	}
+	if !result.Valid() {
+		var errs []string
+		for _, e := range result.Errors() {
+			field := "dynamicOptions"
+			if e.Field() != gojsonschema.STRING_CONTEXT_ROOT {
+				field += "." + e.Field()
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", field, e.Description()))
+		}
+		return nil, fmt.Errorf("invalid dynamicOptions: %s", strings.Join(errs, "; "))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(options); err != nil {
+		return nil, fmt.Errorf("failed to decode dynamicOptions: %v", err)
+	}
+	return options, nil
+}
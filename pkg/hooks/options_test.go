@@ -0,0 +1,68 @@
+package hooks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/config"
+)
+
+type testOptions struct {
+	Tag      string            `json:"tag"`
+	Replicas int               `json:"replicas"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type testHook struct{}
+
+func (h *testHook) Run(_ context.Context, _ client.Client, _ *config.ExtensionUpgradeHookConfig, _ *Environment) error {
+	return nil
+}
+
+func (h *testHook) DefaultOptions() interface{} {
+	return &testOptions{Tag: "v1.0.0", Replicas: 1}
+}
+
+func (h *testHook) OptionsSchema() string {
+	return `{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "tag": {"type": "string"},
+    "replicas": {"type": "integer", "minimum": 1},
+    "labels": {"type": "object", "additionalProperties": {"type": "string"}}
+  }
+}`
+}
+
+type plainHook struct{}
+
+func (h *plainHook) Run(_ context.Context, _ client.Client, _ *config.ExtensionUpgradeHookConfig, _ *Environment) error {
+	return nil
+}
+
+func TestDecodeOptions(t *testing.T) {
+	options, err := DecodeOptions(&plainHook{}, config.DynamicOptions{"tag": "v2.0.0"})
+	assert.NoError(t, err)
+	assert.Nil(t, options)
+
+	options, err = DecodeOptions(&testHook{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &testOptions{Tag: "v1.0.0", Replicas: 1}, options)
+
+	options, err = DecodeOptions(&testHook{}, config.DynamicOptions{"tag": "v2.0.0", "labels": map[string]interface{}{"app": "test"}})
+	assert.NoError(t, err)
+	assert.Equal(t, &testOptions{Tag: "v2.0.0", Replicas: 1, Labels: map[string]string{"app": "test"}}, options)
+
+	_, err = DecodeOptions(&testHook{}, config.DynamicOptions{"replicas": 0})
+	assert.ErrorContains(t, err, "dynamicOptions.replicas: Must be greater than or equal to 1")
+
+	_, err = DecodeOptions(&testHook{}, config.DynamicOptions{"labels": map[string]interface{}{"app": 1}})
+	assert.ErrorContains(t, err, "dynamicOptions.labels.app: Invalid type")
+
+	_, err = DecodeOptions(&testHook{}, config.DynamicOptions{"tags": "v2.0.0"})
+	assert.ErrorContains(t, err, "dynamicOptions: Additional property tags is not allowed")
+}
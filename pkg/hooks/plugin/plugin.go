@@ -0,0 +1,263 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chart"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/config"
+	"github.com/kubesphere-extensions/upgrade/pkg/hooks"
+)
+
+const (
+	// HooksDir is the directory in the chart archive containing plugin hooks.
+	HooksDir = "upgrade/hooks"
+	// ManifestFile is the manifest describing the plugin hooks in HooksDir, which is required so that
+	// other files, e.g. READMEs, are never executed.
+	ManifestFile = "hooks.yaml"
+
+	APIVersion   = "upgrade.kubesphere.io/v1alpha1"
+	KindRequest  = "HookRequest"
+	KindResponse = "HookResponse"
+
+	EnvExtensionName = "EXTENSION_NAME"
+	EnvHookName      = "HOOK_NAME"
+
+	defaultTimeout = 60 * time.Second
+	// maxOutputSize limits the size of the response read from stdout.
+	maxOutputSize = 4 << 20
+)
+
+// Manifest describes the plugin hooks shipped in a chart.
+type Manifest struct {
+	Hooks []Hook `json:"hooks"`
+}
+
+// Hook is an executable shipped in the chart that runs as a subprocess.
+type Hook struct {
+	Name string `json:"name"`
+	// Script is the path of the executable relative to HooksDir.
+	Script string `json:"script"`
+	// Command is an optional interpreter, the script path is appended as the last argument.
+	Command []string `json:"command,omitempty"`
+	// Timeout defaults to 60s.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Agent indicates that the hook runs for the agent release instead of the extension release.
+	Agent bool `json:"agent,omitempty"`
+	// Actions limits the hook to the given actions (install, upgrade), empty means all actions.
+	Actions []string `json:"actions,omitempty"`
+
+	data []byte
+}
+
+// Request is written to the stdin of the hook as JSON.
+type Request struct {
+	APIVersion     string                `json:"apiVersion"`
+	Kind           string                `json:"kind"`
+	Name           string                `json:"name"`
+	ExtensionName  string                `json:"extensionName"`
+	ReleaseName    string                `json:"releaseName"`
+	Action         string                `json:"action"`
+	Agent          bool                  `json:"agent"`
+	ClusterRole    string                `json:"clusterRole,omitempty"`
+	ClusterName    string                `json:"clusterName,omitempty"`
+	CurrentVersion string                `json:"currentVersion,omitempty"`
+	TargetVersion  string                `json:"targetVersion,omitempty"`
+	Config         string                `json:"config,omitempty"`
+	DynamicOptions config.DynamicOptions `json:"dynamicOptions,omitempty"`
+}
+
+// Response is read from the stdout of the hook, an empty stdout is treated as an empty response.
+type Response struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Message    string `json:"message,omitempty"`
+	// Config replaces the InstallPlan config of the extension when not empty.
+	Config string `json:"config,omitempty"`
+}
+
+// LoadHooks loads the plugin hooks declared by the manifest in HooksDir of the chart.
+func LoadHooks(ch *chart.Chart) ([]Hook, error) {
+	files := make(map[string][]byte)
+	for _, f := range ch.Files {
+		if strings.HasPrefix(f.Name, HooksDir+"/") {
+			files[strings.TrimPrefix(f.Name, HooksDir+"/")] = f.Data
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	data, ok := files[ManifestFile]
+	if !ok {
+		return nil, fmt.Errorf("%s/%s is required to run the plugin hooks in %s", HooksDir, ManifestFile, HooksDir)
+	}
+	manifest := &Manifest{}
+	if err := yaml.UnmarshalStrict(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s/%s: %v", HooksDir, ManifestFile, err)
+	}
+
+	for i := range manifest.Hooks {
+		hook := &manifest.Hooks[i]
+		if hook.Script == "" {
+			return nil, fmt.Errorf("plugin hook %q: script is required", hook.Name)
+		}
+		if hook.Name == "" {
+			hook.Name = hook.Script
+		}
+		data, ok := files[path.Clean(hook.Script)]
+		if !ok {
+			return nil, fmt.Errorf("plugin hook %q: script %s not found in %s", hook.Name, hook.Script, HooksDir)
+		}
+		hook.data = data
+	}
+	return manifest.Hooks, nil
+}
+
+// Matches returns true if the hook should run in the given environment.
+func (h *Hook) Matches(env *hooks.Environment) bool {
+	if h.Agent != env.Agent {
+		return false
+	}
+	if len(h.Actions) == 0 {
+		return true
+	}
+	for _, action := range h.Actions {
+		if action == env.Action {
+			return true
+		}
+	}
+	return false
+}
+
+// Runner executes plugin hooks as subprocesses in a temporary working directory.
+type Runner struct {
+	workDir string
+}
+
+func NewRunner() (*Runner, error) {
+	workDir, err := os.MkdirTemp("", "upgrade-hooks-")
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{workDir: workDir}, nil
+}
+
+// Close removes the working directory of the runner.
+func (r *Runner) Close() error {
+	return os.RemoveAll(r.workDir)
+}
+
+// Run executes the hook with the JSON request on stdin and returns the decoded response from stdout.
+// Stderr of the hook is forwarded to the log.
+func (r *Runner) Run(ctx context.Context, hook *Hook, req *Request) (*Response, error) {
+	script := filepath.Join(r.workDir, filepath.FromSlash(path.Clean(hook.Script)))
+	if err := os.MkdirAll(filepath.Dir(script), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(script, hook.data, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to write script %s: %v", hook.Script, err)
+	}
+
+	timeout := defaultTimeout
+	if hook.Timeout != nil && hook.Timeout.Duration > 0 {
+		timeout = hook.Timeout.Duration
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	args := append(append([]string{}, hook.Command...), script)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = r.workDir
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", EnvExtensionName, req.ExtensionName),
+		fmt.Sprintf("%s=%s", EnvHookName, hook.Name),
+	)
+
+	req.APIVersion = APIVersion
+	req.Kind = KindRequest
+	req.Name = hook.Name
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = bytes.NewReader(input)
+
+	stdout := &limitedBuffer{limit: maxOutputSize}
+	stderr := &logWriter{name: hook.Name}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Do not wait forever for orphaned child processes holding the output pipes.
+	cmd.WaitDelay = 5 * time.Second
+
+	err = cmd.Run()
+	stderr.Flush()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("plugin hook %s timed out after %s", hook.Name, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("plugin hook %s failed: %v", hook.Name, err)
+	}
+
+	resp := &Response{}
+	if output := bytes.TrimSpace(stdout.Bytes()); len(output) > 0 {
+		if err := json.Unmarshal(output, resp); err != nil {
+			return nil, fmt.Errorf("failed to decode response of plugin hook %s: %v", hook.Name, err)
+		}
+	}
+	return resp, nil
+}
+
+// logWriter forwards the written data to the log line by line.
+type logWriter struct {
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// keep the incomplete line for the next write
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		klog.Infof("[plugin hook %s] %s", w.name, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (w *logWriter) Flush() {
+	if w.buf.Len() > 0 {
+		klog.Infof("[plugin hook %s] %s", w.name, w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+// limitedBuffer discards the data exceeding the limit to protect against runaway hooks.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remain := b.limit - b.Len(); remain < len(p) {
+		if remain > 0 {
+			b.Buffer.Write(p[:remain])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kubesphere-extensions/upgrade/pkg/hooks"
+)
+
+func TestLoadHooks(t *testing.T) {
+	ch := &chart.Chart{Files: []*chart.File{
+		{Name: "README.md", Data: []byte("readme")},
+		{Name: "upgrade/hooks/b.sh", Data: []byte("#!/bin/sh\n")},
+		{Name: "upgrade/hooks/a.sh", Data: []byte("#!/bin/sh\n")},
+	}}
+	// the files are never executed without a manifest
+	_, err := LoadHooks(ch)
+	assert.ErrorContains(t, err, "upgrade/hooks/hooks.yaml is required")
+
+	ch.Files = append(ch.Files, &chart.File{Name: "upgrade/hooks/hooks.yaml", Data: []byte(`
+hooks:
+- name: migrate
+  script: a.sh
+  command: ["/bin/sh"]
+  timeout: 10s
+  agent: true
+  actions: [upgrade]
+`)})
+	loaded, err := LoadHooks(ch)
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 1)
+	assert.Equal(t, []string{"/bin/sh"}, loaded[0].Command)
+	assert.True(t, loaded[0].Matches(&hooks.Environment{Agent: true, Action: "upgrade"}))
+	assert.False(t, loaded[0].Matches(&hooks.Environment{Agent: true, Action: "install"}))
+	assert.False(t, loaded[0].Matches(&hooks.Environment{Agent: false, Action: "upgrade"}))
+
+	ch.Files[len(ch.Files)-1].Data = []byte("hooks:\n- name: missing\n  script: c.sh\n")
+	_, err = LoadHooks(ch)
+	assert.Error(t, err)
+}
+
+func TestRunnerRun(t *testing.T) {
+	runner, err := NewRunner()
+	assert.NoError(t, err)
+	defer runner.Close()
+
+	hook := &Hook{Name: "echo", Script: "echo.sh", data: []byte(`#!/bin/sh
+read -r input
+echo "received request" >&2
+case "$input" in
+  *'"action":"upgrade"'*) echo '{"message":"done","config":"foo: bar"}' ;;
+  *) exit 3 ;;
+esac
+`)}
+	resp, err := runner.Run(context.Background(), hook, &Request{ExtensionName: "test", Action: "upgrade"})
+	assert.NoError(t, err)
+	assert.Equal(t, "done", resp.Message)
+	assert.Equal(t, "foo: bar", resp.Config)
+
+	_, err = runner.Run(context.Background(), hook, &Request{ExtensionName: "test", Action: "install"})
+	assert.ErrorContains(t, err, "exit status 3")
+
+	hook = &Hook{Name: "sleep", Script: "sleep.sh", Command: []string{"/bin/sh"}, data: []byte("exec sleep 10\n")}
+	hook.Timeout = &metav1.Duration{Duration: 100 * time.Millisecond}
+	_, err = runner.Run(context.Background(), hook, &Request{})
+	assert.ErrorContains(t, err, "timed out")
+
+	hook = &Hook{Name: "invalid", Script: "invalid.sh", Command: []string{"/bin/sh"}, data: []byte("echo not-json\n")}
+	_, err = runner.Run(context.Background(), hook, &Request{})
+	assert.ErrorContains(t, err, "failed to decode response")
+}
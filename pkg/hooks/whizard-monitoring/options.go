@@ -0,0 +1,82 @@
+package whizardmonitoring
+
+// Options of the whizard-monitoring hook, set by `dynamicOptions` in the upgrade config.
+type Options struct {
+	// RemoveImageTags are removed from the InstallPlan config when upgrading to 1.2.x if the tag matches.
+	RemoveImageTags []ImageTag `json:"removeImageTags,omitempty"`
+	// RenameValues copies the values of the renamed subcharts when upgrading to 1.2.x.
+	RenameValues []RenameValue `json:"renameValues,omitempty"`
+	// InstallWhizardMonitoringPro creates the whizard-monitoring-pro InstallPlan if the legacy whizard is enabled.
+	InstallWhizardMonitoringPro bool `json:"installWhizardMonitoringPro"`
+}
+
+type ImageTag struct {
+	// Path is the dot separated values path of the image tag.
+	Path string `json:"path"`
+	Tag  string `json:"tag"`
+}
+
+type RenameValue struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func NewDefaultOptions() *Options {
+	return &Options{
+		RemoveImageTags: []ImageTag{
+			{Path: "kube-prometheus-stack.prometheus.prometheusSpec.image.tag", Tag: "v2.51.2"},
+			{Path: "kube-prometheus-stack.prometheusOperator.image.tag", Tag: "v0.75.1"},
+			{Path: "kube-prometheus-stack.prometheusOperator.admissionWebhooks.patch.image.tag", Tag: "v20221220-controller-v1.5.1-58-g787ea74b6"},
+			{Path: "kube-prometheus-stack.prometheusOperator.prometheusConfigReloader.image.tag", Tag: "v0.75.1"},
+			{Path: "kube-prometheus-stack.kube-state-metrics.image.tag", Tag: "v2.12.0"},
+			{Path: "kube-prometheus-stack.kube-state-metrics.kubeRBACProxy.image.tag", Tag: "v0.18.0"},
+			{Path: "kube-prometheus-stack.prometheus-node-exporter.image.tag", Tag: "v1.8.1"},
+			{Path: "kube-prometheus-stack.prometheus-node-exporter.kubeRBACProxy.image.tag", Tag: "v0.18.0"},
+		},
+		RenameValues: []RenameValue{
+			{From: "whizard-monitoring-helper", To: "wiztelemetry-monitoring-helper"},
+		},
+		InstallWhizardMonitoringPro: true,
+	}
+}
+
+const optionsSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "removeImageTags": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["path", "tag"],
+        "properties": {
+          "path": {"type": "string", "minLength": 1},
+          "tag": {"type": "string", "minLength": 1}
+        }
+      }
+    },
+    "renameValues": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["from", "to"],
+        "properties": {
+          "from": {"type": "string", "minLength": 1},
+          "to": {"type": "string", "minLength": 1}
+        }
+      }
+    },
+    "installWhizardMonitoringPro": {"type": "boolean"}
+  }
+}`
+
+func (h *WhizardMonitoringHook) DefaultOptions() interface{} {
+	return NewDefaultOptions()
+}
+
+func (h *WhizardMonitoringHook) OptionsSchema() string {
+	return optionsSchema
+}
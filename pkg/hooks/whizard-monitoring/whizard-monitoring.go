@@ -1,13 +1,11 @@
 package whizardmonitoring
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"strings"
 
-	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/chartutil"
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/version"
@@ -16,8 +14,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/kubesphere-extensions/upgrade/pkg/config"
+	"github.com/kubesphere-extensions/upgrade/pkg/extension"
 	"github.com/kubesphere-extensions/upgrade/pkg/hooks"
-	"github.com/kubesphere-extensions/upgrade/pkg/utils/download"
 )
 
 const (
@@ -32,18 +30,20 @@ func init() {
 
 type WhizardMonitoringHook struct{}
 
-func (h *WhizardMonitoringHook) Run(ctx context.Context, cli client.Client, cfg *config.ExtensionUpgradeHookConfig) error {
-
-	hook := &upgradeHook{
-		client: cli,
-		cfg:    cfg,
+func (h *WhizardMonitoringHook) Run(ctx context.Context, cli client.Client, cfg *config.ExtensionUpgradeHookConfig, env *hooks.Environment) error {
+	opts, ok := env.Options.(*Options)
+	if !ok {
+		opts = NewDefaultOptions()
 	}
 
-	chartDownloader, err := download.NewChartDownloader(download.NewDefaultOptions())
-	if err != nil {
-		return fmt.Errorf("failed to create chartDownloader client: %v", err)
+	if env.ChartResolver == nil {
+		return fmt.Errorf("chart resolver is not configured")
+	}
+	hook := &upgradeHook{
+		client:        cli,
+		cfg:           cfg,
+		chartResolver: env.ChartResolver,
 	}
-	hook.chartDownloader = chartDownloader
 
 	installPlan := &kscorev1alpha1.InstallPlan{}
 	if err := cli.Get(ctx, types.NamespacedName{Name: extensionHookName}, installPlan); err != nil {
@@ -59,7 +59,7 @@ func (h *WhizardMonitoringHook) Run(ctx context.Context, cli client.Client, cfg
 	if currentVersion.LessThan(v12) && (expectVersion.GreaterThan(v12) || expectVersion.EqualTo(v12)) {
 
 		// Do not block the upgrade process
-		if cfg, err := genWhizardMonitoringSmoothUpgradeConfig(installPlan.Spec.Config); err == nil {
+		if cfg, err := genWhizardMonitoringSmoothUpgradeConfig(installPlan.Spec.Config, opts); err == nil {
 			patch := client.MergeFrom(installPlan.DeepCopy())
 			installPlan.Spec.Config = cfg
 			if err := hook.client.Patch(ctx, installPlan, patch); err != nil {
@@ -68,8 +68,10 @@ func (h *WhizardMonitoringHook) Run(ctx context.Context, cli client.Client, cfg
 		} else {
 			klog.Errorf("failed to generate whizard-monitoring smooth upgrade config: %v", err)
 		}
-		if err := hook.installWhizardMonitoringProExtension(ctx, installPlan); err != nil {
-			klog.Errorf("failed to install whizard-monitoring-pro extension: %v", err)
+		if opts.InstallWhizardMonitoringPro {
+			if err := hook.installWhizardMonitoringProExtension(ctx, installPlan); err != nil {
+				klog.Errorf("failed to install whizard-monitoring-pro extension: %v", err)
+			}
 		}
 	}
 
@@ -77,12 +79,12 @@ func (h *WhizardMonitoringHook) Run(ctx context.Context, cli client.Client, cfg
 }
 
 type upgradeHook struct {
-	client          client.Client
-	cfg             *config.ExtensionUpgradeHookConfig
-	chartDownloader *download.ChartDownloader
+	client        client.Client
+	cfg           *config.ExtensionUpgradeHookConfig
+	chartResolver *extension.ChartResolver
 }
 
-func genWhizardMonitoringSmoothUpgradeConfig(config string) (string, error) {
+func genWhizardMonitoringSmoothUpgradeConfig(config string, opts *Options) (string, error) {
 	klog.Info("generate whizard monitoring smooth upgrade config, remove tag from image")
 
 	installPlanValues, err := chartutil.ReadValues([]byte(config))
@@ -90,46 +92,33 @@ func genWhizardMonitoringSmoothUpgradeConfig(config string) (string, error) {
 		return "", fmt.Errorf("failed to parse installPlan config: %v", err)
 	}
 
-	if prometheusTag, err := installPlanValues.PathValue("kube-prometheus-stack.prometheus.prometheusSpec.image.tag"); err == nil && prometheusTag.(string) == "v2.51.2" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["prometheus"].(map[string]interface{})["prometheusSpec"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
-	}
-
-	if prometheusOperaterTag, err := installPlanValues.PathValue("kube-prometheus-stack.prometheusOperator.image.tag"); err == nil && prometheusOperaterTag.(string) == "v0.75.1" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["prometheusOperator"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
-	}
-
-	if admissionWebhooksPathTag, err := installPlanValues.PathValue("kube-prometheus-stack.prometheusOperator.admissionWebhooks.patch.image.tag"); err == nil && admissionWebhooksPathTag.(string) == "v20221220-controller-v1.5.1-58-g787ea74b6" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["prometheusOperator"].(map[string]interface{})["admissionWebhooks"].(map[string]interface{})["patch"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
-	}
-
-	if prometheusConfigReloaderTag, err := installPlanValues.PathValue("kube-prometheus-stack.prometheusOperator.prometheusConfigReloader.image.tag"); err == nil && prometheusConfigReloaderTag.(string) == "v0.75.1" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["prometheusOperator"].(map[string]interface{})["prometheusConfigReloader"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
-	}
-
-	if kubeStateMetricsTag, err := installPlanValues.PathValue("kube-prometheus-stack.kube-state-metrics.image.tag"); err == nil && kubeStateMetricsTag.(string) == "v2.12.0" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["kube-state-metrics"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
-	}
-
-	if kubeRBACProxyTag, err := installPlanValues.PathValue("kube-prometheus-stack.kube-state-metrics.kubeRBACProxy.image.tag"); err == nil && kubeRBACProxyTag.(string) == "v0.18.0" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["kube-state-metrics"].(map[string]interface{})["kubeRBACProxy"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
-	}
-
-	if nodeExporterTag, err := installPlanValues.PathValue("kube-prometheus-stack.prometheus-node-exporter.image.tag"); err == nil && nodeExporterTag.(string) == "v1.8.1" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["prometheus-node-exporter"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
-	}
-
-	if kubeRbacProxyTag, err := installPlanValues.PathValue("kube-prometheus-stack.prometheus-node-exporter.kubeRBACProxy.image.tag"); err == nil && kubeRbacProxyTag.(string) == "v0.18.0" {
-		delete(installPlanValues.AsMap()["kube-prometheus-stack"].(map[string]interface{})["prometheus-node-exporter"].(map[string]interface{})["kubeRBACProxy"].(map[string]interface{})["image"].(map[string]interface{}), "tag")
+	// Remove the image tags pinned by the old version, so that the image tags of the new chart are used
+	for _, image := range opts.RemoveImageTags {
+		if tag, err := installPlanValues.PathValue(image.Path); err == nil && tag == image.Tag {
+			removeValue(installPlanValues, image.Path)
+		}
 	}
 
 	// subchart  whizard-monitoring-helper has been renamed to wiztelemetry-monitoring-helper in v1.2.0
-	if _, err := installPlanValues.Table("whizard-monitoring-helper"); err == nil {
-		installPlanValues["wiztelemetry-monitoring-helper"] = installPlanValues["whizard-monitoring-helper"]
+	for _, rename := range opts.RenameValues {
+		if _, err := installPlanValues.Table(rename.From); err == nil {
+			installPlanValues[rename.To] = installPlanValues[rename.From]
+		}
 	}
 
 	return installPlanValues.YAML()
 }
 
+// removeValue removes the value of the dot separated path from the values.
+func removeValue(values chartutil.Values, path string) {
+	keys := strings.Split(path, ".")
+	table, err := values.Table(strings.Join(keys[:len(keys)-1], "."))
+	if err != nil {
+		return
+	}
+	delete(table, keys[len(keys)-1])
+}
+
 func checkWhizardConfig(whizardMonitoringCfg string) (interface{}, error) {
 	klog.Info("Check whether whizard is installed and get its config")
 
@@ -168,34 +157,9 @@ func (h *upgradeHook) installWhizardMonitoringProExtension(ctx context.Context,
 	}
 	if whizardMonitoringProExtension.Status.State == "" && whizardMonitoringProExtension.Status.RecommendedVersion != "" {
 
-		whizardMonitoringProExtensionVersion := &kscorev1alpha1.ExtensionVersion{}
-		if err := h.client.Get(ctx, client.ObjectKey{
-			Name: WhizardMonitoringProExtensionName + "-" + whizardMonitoringProExtension.Status.RecommendedVersion,
-		}, whizardMonitoringProExtensionVersion); err != nil {
-			return err
-		}
-
-		var chartBuf *bytes.Buffer
-		if whizardMonitoringProExtensionVersion.Spec.ChartURL != "" {
-			if chartBuf, err = h.chartDownloader.Download(whizardMonitoringProExtensionVersion.Spec.ChartURL); err != nil {
-				return fmt.Errorf("failed to download chart %s: %v", whizardMonitoringProExtensionVersion.Spec.ChartURL, err)
-			}
-		} else if whizardMonitoringProExtensionVersion.Spec.ChartDataRef != nil {
-			cm := corev1.ConfigMap{}
-
-			if err := h.client.Get(ctx, types.NamespacedName{Name: whizardMonitoringProExtensionVersion.Spec.ChartDataRef.Name, Namespace: whizardMonitoringProExtensionVersion.Spec.ChartDataRef.Namespace}, &cm); err != nil {
-				return fmt.Errorf("failed to get configmap %s: %v", cm.Name, err)
-			}
-			chartBytes, ok := cm.BinaryData[whizardMonitoringProExtensionVersion.Spec.ChartDataRef.Key]
-			if !ok {
-				return fmt.Errorf("failed to get chart data from configmap %s", cm.Name)
-			}
-			chartBuf = bytes.NewBuffer(chartBytes)
-		}
-
-		chart, err := loader.LoadArchive(chartBuf)
+		chart, err := h.chartResolver.Resolve(ctx, WhizardMonitoringProExtensionName, whizardMonitoringProExtension.Status.RecommendedVersion)
 		if err != nil {
-			return fmt.Errorf("failed to load chart data: %v", err)
+			return err
 		}
 		whizardMonitoringProDefaultValues := chartutil.Values(chart.Values)
 		whizardMonitoringProDefaultValues["whizard-agent-proxy"] = map[string]interface{}{
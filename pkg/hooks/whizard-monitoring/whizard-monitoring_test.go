@@ -1,6 +1,7 @@
 package whizardmonitoring
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -157,10 +158,16 @@ dcgmExporter:
 `
 
 	t.Run("test gen whizard monitoring smooth upgrade config", func(t *testing.T) {
-		config, err := genWhizardMonitoringSmoothUpgradeConfig(defaultconfig)
+		config, err := genWhizardMonitoringSmoothUpgradeConfig(defaultconfig, NewDefaultOptions())
 		if err != nil {
 			t.Errorf("failed to gen whizard monitoring smooth upgrade config: %v", err)
 		}
 		t.Logf("config: %s", config)
+		if strings.Contains(config, "v2.51.2") || strings.Contains(config, "v0.75.1") {
+			t.Errorf("image tags are not removed")
+		}
+		if !strings.Contains(config, "wiztelemetry-monitoring-helper:") {
+			t.Errorf("whizard-monitoring-helper is not renamed")
+		}
 	})
 }
@@ -0,0 +1,305 @@
+package download
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const defaultCacheTTL = time.Hour
+
+// CacheOptions configures the chart cache of the ChartDownloader, which keeps the chart archives by digest
+// in memory and optionally in a directory shared by the runs of the same Job. The cache is only enabled if
+// it is configured, since the charts are buffered in memory rather than streamed when it is enabled.
+// The charts from files and in-cluster objects are never cached.
+type CacheOptions struct {
+	// Disabled disables the cache, the charts are downloaded on each call.
+	Disabled bool `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	// Dir is the cache directory, environment variables are expanded, e.g. `$HELM_CACHE_HOME/extension-upgrade`.
+	// The charts are only cached in memory if it is empty.
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+	// TTL is how long the digest of a chart URI is cached, defaults to 1h. The archives are content addressed,
+	// so that the downloads with expected digests hit the cache regardless of the TTL.
+	TTL *metav1.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	// MaxSize is the maximum total bytes of the archives in memory and in the directory respectively,
+	// the least recently used archives are evicted first. 0 means no limit.
+	MaxSize int64 `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+}
+
+// ChartCache is a content addressed cache of chart archives, it is safe for concurrent use.
+// The archives are only added after they are verified, and are verified against their digests
+// when they are read from the directory.
+type ChartCache struct {
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+	now     func() time.Time
+
+	mu    sync.Mutex
+	refs  map[string]cacheRef
+	blobs map[string]*list.Element
+	lru   *list.List
+	size  int64
+}
+
+// cacheRef records the digest of the archive of a URI.
+type cacheRef struct {
+	URI     string    `json:"uri"`
+	Digest  string    `json:"digest"`
+	Fetched time.Time `json:"fetched"`
+}
+
+type cacheBlob struct {
+	digest string
+	data   []byte
+}
+
+// NewChartCache returns nil if the options are nil or the cache is disabled.
+func NewChartCache(options *CacheOptions) (*ChartCache, error) {
+	if options == nil || options.Disabled {
+		return nil, nil
+	}
+	c := &ChartCache{
+		ttl:   defaultCacheTTL,
+		now:   time.Now,
+		refs:  make(map[string]cacheRef),
+		blobs: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+	if options.TTL != nil && options.TTL.Duration > 0 {
+		c.ttl = options.TTL.Duration
+	}
+	if options.MaxSize < 0 {
+		return nil, errors.Errorf("invalid cache maxSize %d", options.MaxSize)
+	}
+	c.maxSize = options.MaxSize
+	if options.Dir != "" {
+		c.dir = os.ExpandEnv(options.Dir)
+		for _, dir := range []string{c.blobDir(), c.refDir()} {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, errors.Errorf("failed to create cache directory: %v", err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *ChartCache) blobDir() string {
+	return filepath.Join(c.dir, "blobs", "sha256")
+}
+
+func (c *ChartCache) refDir() string {
+	return filepath.Join(c.dir, "refs")
+}
+
+func (c *ChartCache) refPath(uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	return filepath.Join(c.refDir(), hex.EncodeToString(sum[:])+".json")
+}
+
+// Get returns the archive of the digest if it is not empty, otherwise the archive last cached for the URI
+// within the TTL.
+func (c *ChartCache) Get(uri, digest string) ([]byte, bool) {
+	if digest == "" {
+		ref, ok := c.ref(uri)
+		if !ok || c.now().Sub(ref.Fetched) > c.ttl {
+			return nil, false
+		}
+		digest = ref.Digest
+	}
+	encoded, err := parseDigest(digest)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.blobs[encoded]; ok {
+		c.lru.MoveToFront(elem)
+		c.mu.Unlock()
+		c.touch(encoded)
+		return elem.Value.(*cacheBlob).data, true
+	}
+	c.mu.Unlock()
+
+	data, ok := c.readBlob(encoded)
+	if !ok {
+		return nil, false
+	}
+	c.addBlob(encoded, data)
+	return data, true
+}
+
+// Put caches the archive of the URI, it returns the digest of the archive.
+func (c *ChartCache) Put(uri string, data []byte) string {
+	sum := sha256.Sum256(data)
+	encoded := hex.EncodeToString(sum[:])
+	ref := cacheRef{URI: uri, Digest: "sha256:" + encoded, Fetched: c.now()}
+
+	c.mu.Lock()
+	c.refs[uri] = ref
+	c.mu.Unlock()
+	c.addBlob(encoded, data)
+
+	if c.dir != "" {
+		if err := c.writeBlob(encoded, data); err != nil {
+			klog.Warningf("failed to cache chart %s: %v", RedactURL(uri), err)
+			return ref.Digest
+		}
+		if data, err := json.Marshal(ref); err == nil {
+			if err := writeFileAtomic(c.refPath(uri), data); err != nil {
+				klog.Warningf("failed to cache chart %s: %v", RedactURL(uri), err)
+			}
+		}
+	}
+	return ref.Digest
+}
+
+func (c *ChartCache) ref(uri string) (cacheRef, bool) {
+	c.mu.Lock()
+	ref, ok := c.refs[uri]
+	c.mu.Unlock()
+	if ok || c.dir == "" {
+		return ref, ok
+	}
+	data, err := os.ReadFile(c.refPath(uri))
+	if err != nil {
+		return ref, false
+	}
+	if err := json.Unmarshal(data, &ref); err != nil || ref.URI != uri {
+		return ref, false
+	}
+	return ref, true
+}
+
+// addBlob adds the archive to memory and evicts the least recently used archives beyond the max size.
+func (c *ChartCache) addBlob(encoded string, data []byte) {
+	if c.maxSize > 0 && int64(len(data)) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.blobs[encoded]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.blobs[encoded] = c.lru.PushFront(&cacheBlob{digest: encoded, data: data})
+	c.size += int64(len(data))
+	for c.maxSize > 0 && c.size > c.maxSize {
+		blob := c.lru.Remove(c.lru.Back()).(*cacheBlob)
+		delete(c.blobs, blob.digest)
+		c.size -= int64(len(blob.data))
+	}
+}
+
+// readBlob reads the archive from the directory, the archives not matching their digests are removed.
+func (c *ChartCache) readBlob(encoded string) ([]byte, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	path := filepath.Join(c.blobDir(), encoded)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	if err := VerifyDigest(data, encoded); err != nil {
+		klog.Warningf("removing corrupted cache %s: %v", path, err)
+		_ = os.Remove(path)
+		return nil, false
+	}
+	c.touch(encoded)
+	return data, true
+}
+
+// touch updates the modification time of the archive in the directory, which is the last access time
+// used for the eviction.
+func (c *ChartCache) touch(encoded string) {
+	if c.dir == "" {
+		return
+	}
+	now := c.now()
+	_ = os.Chtimes(filepath.Join(c.blobDir(), encoded), now, now)
+}
+
+// writeBlob writes the archive to the directory and evicts the least recently used archives beyond the max size.
+func (c *ChartCache) writeBlob(encoded string, data []byte) error {
+	if c.maxSize > 0 && int64(len(data)) > c.maxSize {
+		return nil
+	}
+	path := filepath.Join(c.blobDir(), encoded)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+	}
+	c.touch(encoded)
+	if c.maxSize > 0 {
+		return c.prune(encoded)
+	}
+	return nil
+}
+
+// prune removes the least recently used archives in the directory except the given one until the total
+// size is within the max size.
+func (c *ChartCache) prune(keep string) error {
+	entries, err := os.ReadDir(c.blobDir())
+	if err != nil {
+		return err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		infos = append(infos, info)
+		size += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		if size <= c.maxSize {
+			break
+		}
+		if info.Name() == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.blobDir(), info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= info.Size()
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file by renaming a temporary file, so that concurrent readers never see
+// partial content.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
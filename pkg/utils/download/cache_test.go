@@ -0,0 +1,163 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestChartDownloaderCache(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	options := &Options{Cache: &CacheOptions{Dir: dir}}
+
+	chartDownloader, err := NewChartDownloader(options)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		buf, err := chartDownloader.Download(context.Background(), server.URL+"/devops-1.2.0.tgz")
+		require.NoError(t, err)
+		assert.Equal(t, "/devops-1.2.0.tgz", buf.String())
+	}
+	assert.EqualValues(t, 1, requests.Load())
+
+	// the archives are content addressed
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("/devops-1.2.0.tgz")))
+	buf, err := chartDownloader.Download(context.Background(), server.URL+"/mirror/devops-1.2.0.tgz", WithDigest(digest))
+	require.NoError(t, err)
+	assert.Equal(t, "/devops-1.2.0.tgz", buf.String())
+	assert.EqualValues(t, 1, requests.Load())
+
+	// the cache directory is shared by the ChartDownloaders
+	chartDownloader, err = NewChartDownloader(options)
+	require.NoError(t, err)
+	buf, err = chartDownloader.Download(context.Background(), server.URL+"/devops-1.2.0.tgz")
+	require.NoError(t, err)
+	assert.Equal(t, "/devops-1.2.0.tgz", buf.String())
+	assert.EqualValues(t, 1, requests.Load())
+
+	// the memory cache is shared by WithChartCache
+	shared, err := NewChartDownloader(&Options{}, WithChartCache(chartDownloader.Cache()))
+	require.NoError(t, err)
+	_, err = shared.Download(context.Background(), server.URL+"/devops-1.2.0.tgz")
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, requests.Load())
+
+	chartDownloader, err = NewChartDownloader(&Options{Cache: &CacheOptions{Disabled: true}})
+	require.NoError(t, err)
+	assert.Nil(t, chartDownloader.Cache())
+	for i := 0; i < 2; i++ {
+		_, err = chartDownloader.Download(context.Background(), server.URL+"/devops-1.2.0.tgz")
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 3, requests.Load())
+
+	// the cache is opt-in
+	chartDownloader, err = NewChartDownloader(&Options{})
+	require.NoError(t, err)
+	assert.Nil(t, chartDownloader.Cache())
+}
+
+func TestChartDownloaderCacheLocalCharts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devops-1.2.0.tgz")
+	chartDownloader, err := NewChartDownloader(&Options{Cache: &CacheOptions{}})
+	require.NoError(t, err)
+
+	for _, content := range []string{"1.2.0", "1.2.1"} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		buf, err := chartDownloader.Download(context.Background(), path)
+		require.NoError(t, err)
+		assert.Equal(t, content, buf.String())
+	}
+}
+
+func TestChartCacheTTL(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewChartCache(&CacheOptions{Dir: dir, TTL: &metav1.Duration{Duration: time.Minute}})
+	require.NoError(t, err)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	digest := cache.Put("https://charts.local/devops-1.2.0.tgz", []byte("devops"))
+	data, ok := cache.Get("https://charts.local/devops-1.2.0.tgz", "")
+	require.True(t, ok)
+	assert.Equal(t, "devops", string(data))
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.Get("https://charts.local/devops-1.2.0.tgz", "")
+	assert.False(t, ok)
+	// the archive is still available by digest
+	data, ok = cache.Get("https://charts.local/devops-1.2.0.tgz", digest)
+	require.True(t, ok)
+	assert.Equal(t, "devops", string(data))
+
+	// the expiration applies to the directory as well
+	cache, err = NewChartCache(&CacheOptions{Dir: dir, TTL: &metav1.Duration{Duration: time.Minute}})
+	require.NoError(t, err)
+	cache.now = func() time.Time { return now }
+	_, ok = cache.Get("https://charts.local/devops-1.2.0.tgz", "")
+	assert.False(t, ok)
+}
+
+func TestChartCacheCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewChartCache(&CacheOptions{Dir: dir})
+	require.NoError(t, err)
+	digest := cache.Put("https://charts.local/devops-1.2.0.tgz", []byte("devops"))
+
+	encoded, err := parseDigest(digest)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "blobs", "sha256", encoded)
+	require.NoError(t, os.WriteFile(path, []byte("tampered"), 0o644))
+
+	cache, err = NewChartCache(&CacheOptions{Dir: dir})
+	require.NoError(t, err)
+	_, ok := cache.Get("https://charts.local/devops-1.2.0.tgz", "")
+	assert.False(t, ok)
+	assert.NoFileExists(t, path)
+}
+
+func TestChartCacheMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewChartCache(&CacheOptions{Dir: dir, MaxSize: 10})
+	require.NoError(t, err)
+	now := time.Now()
+	cache.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	a := cache.Put("a", []byte("aaaa"))
+	b := cache.Put("b", []byte("bbbb"))
+	// a is more recently used than b
+	_, ok := cache.Get("a", "")
+	require.True(t, ok)
+	c := cache.Put("c", []byte("cccc"))
+	cache.Put("large", []byte("larger than the max size"))
+
+	for digest, expected := range map[string]bool{a: true, b: false, c: true} {
+		_, ok := cache.Get("", digest)
+		assert.Equal(t, expected, ok, digest)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	_, err = NewChartCache(&CacheOptions{MaxSize: -1})
+	assert.Error(t, err)
+}
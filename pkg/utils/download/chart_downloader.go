@@ -2,10 +2,17 @@ package download
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
+
+	"helm.sh/helm/v3/pkg/provenance"
+	"k8s.io/klog/v2"
 )
 
 type Options struct {
@@ -13,39 +20,128 @@ type Options struct {
 	FileOptions       *FileDownloaderOptions `json:"file" yaml:"file"`
 	HttpOptions       *HttpDownloaderOptions `json:"http" yaml:"http"`
 	OCIOptions        *OCIDownloaderOptions  `json:"oci" yaml:"oci"`
+	S3Options         *S3DownloaderOptions   `json:"s3,omitempty" yaml:"s3,omitempty"`
+	Verification      *VerificationOptions   `json:"verification,omitempty" yaml:"verification,omitempty"`
+	Cache             *CacheOptions          `json:"cache,omitempty" yaml:"cache,omitempty"`
+	// Mirrors rewrite the chart URIs, the first rule matching a URI applies.
+	Mirrors []MirrorRule `json:"mirrors,omitempty" yaml:"mirrors,omitempty"`
 }
 
+// Downloader downloads the charts of the URIs of specific schemes, it must be safe for concurrent use.
+// Downloaders are plugged into the ChartDownloader by WithDownloader.
 type Downloader interface {
-	Get(uri string) (*bytes.Buffer, error)
-	Provides(uri string) bool
+	// Get writes the content of the URI to w, it stops once the context is done.
+	Get(ctx context.Context, uri string, w io.Writer) error
+	// Provides reports whether the downloader handles the URI scheme, the paths without scheme
+	// are handled by the `file` downloader.
+	Provides(scheme string) bool
 }
 
+// defaultDownloadConcurrency is the default number of workers of DownloadAll.
+const defaultDownloadConcurrency = 4
+
+// ChartDownloader is safe for concurrent use, it is shared by the core and the hooks.
 type ChartDownloader struct {
 	globalRegistryUrl url.URL
 
-	defaultDownloader Downloader
-	downloader        []Downloader
+	downloader []Downloader
+
+	digests   map[string]string
+	signatory *provenance.Signatory
+	cache     *ChartCache
+	mirrors   []mirrorRule
+
+	mu      sync.Mutex
+	indexes map[string]*repositoryIndex
 }
 
+// NewDefaultOptions returns the default download options, TLS certificates are verified unless
+// InsecureSkipVerify is set explicitly.
 func NewDefaultOptions() *Options {
 	return &Options{
 		HttpOptions: &HttpDownloaderOptions{
-			Timeout:            30,
-			InsecureSkipVerify: true,
+			Timeout: 30,
 		},
 	}
 }
 
-func NewChartDownloader(options *Options) (*ChartDownloader, error) {
+// ChartDownloaderOption configures the dependencies of the ChartDownloader.
+type ChartDownloaderOption func(*chartDownloaderOptions)
+
+type chartDownloaderOptions struct {
+	secretGetter         SecretGetter
+	configMapGetter      ConfigMapGetter
+	extensionChartGetter ExtensionChartGetter
+	cache                *ChartCache
+	downloaders          []Downloader
+}
+
+// WithSecretGetter enables the options referring to Secrets, e.g. OCIDownloaderOptions.DockerConfigSecret,
+// HttpHostOptions.Secret and S3DownloaderOptions.Secret, and the charts of `secret://<namespace>/<name>/<key>`.
+func WithSecretGetter(getter SecretGetter) ChartDownloaderOption {
+	return func(o *chartDownloaderOptions) {
+		o.secretGetter = getter
+	}
+}
+
+// WithConfigMapGetter enables the charts of `configmap://<namespace>/<name>/<key>`.
+func WithConfigMapGetter(getter ConfigMapGetter) ChartDownloaderOption {
+	return func(o *chartDownloaderOptions) {
+		o.configMapGetter = getter
+	}
+}
+
+// WithExtensionChartGetter enables the charts of `extension://<name>@<version>`.
+func WithExtensionChartGetter(getter ExtensionChartGetter) ChartDownloaderOption {
+	return func(o *chartDownloaderOptions) {
+		o.extensionChartGetter = getter
+	}
+}
+
+// WithDownloader plugs in the downloader, which takes precedence over the built-in downloaders and the
+// previously plugged in ones for the schemes it provides.
+func WithDownloader(downloader Downloader) ChartDownloaderOption {
+	return func(o *chartDownloaderOptions) {
+		o.downloaders = append([]Downloader{downloader}, o.downloaders...)
+	}
+}
+
+// WithChartCache shares the cache with other ChartDownloaders, it overrides Options.Cache.
+func WithChartCache(cache *ChartCache) ChartDownloaderOption {
+	return func(o *chartDownloaderOptions) {
+		o.cache = cache
+	}
+}
+
+func NewChartDownloader(options *Options, opts ...ChartDownloaderOption) (*ChartDownloader, error) {
 	if options == nil {
 		return nil, errors.New("fail to load download options. Field `config.download` is nil")
 	}
-	defaultDownloader := NewFileDownloader(options.FileOptions)
-	httpDownloader, err := NewHttpDownloader(options.HttpOptions)
+	o := &chartDownloaderOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	httpDownloader, err := NewHttpDownloader(options.HttpOptions, o.secretGetter)
 	if err != nil {
 		return nil, err
 	}
-	ociDownloader, err := NewOCIDownloader(options.OCIOptions)
+	// the proxy and transport options of http are shared by the other downloaders unless they have their own
+	ociOptions, s3Options := &OCIDownloaderOptions{}, &S3DownloaderOptions{}
+	if options.OCIOptions != nil {
+		*ociOptions = *options.OCIOptions
+	}
+	if options.S3Options != nil {
+		*s3Options = *options.S3Options
+	}
+	if httpOptions := options.HttpOptions; httpOptions != nil {
+		shareTransport(&ociOptions.Proxy, &ociOptions.Transport, httpOptions)
+		shareTransport(&s3Options.Proxy, &s3Options.Transport, httpOptions)
+	}
+	ociDownloader, err := NewOCIDownloader(ociOptions, o.secretGetter)
+	if err != nil {
+		return nil, err
+	}
+	s3Downloader, err := NewS3Downloader(s3Options, o.secretGetter)
 	if err != nil {
 		return nil, err
 	}
@@ -53,46 +149,288 @@ func NewChartDownloader(options *Options) (*ChartDownloader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ChartDownloader{
+	c := &ChartDownloader{
 		globalRegistryUrl: *globalRegistryUrl,
+		indexes:           make(map[string]*repositoryIndex),
 
-		defaultDownloader: defaultDownloader,
-		downloader: []Downloader{
+		downloader: append(o.downloaders,
+			NewFileDownloader(options.FileOptions),
 			httpDownloader,
 			ociDownloader,
-		},
-	}, nil
+			s3Downloader,
+			NewConfigMapDownloader(o.configMapGetter),
+			NewSecretDownloader(o.secretGetter),
+			NewExtensionDownloader(o.extensionChartGetter),
+		),
+	}
+	if verification := options.Verification; verification != nil {
+		for uri, digest := range verification.Digests {
+			if _, err := parseDigest(digest); err != nil {
+				return nil, fmt.Errorf("invalid digest of chart %s: %v", RedactURL(uri), err)
+			}
+		}
+		c.digests = verification.Digests
+		if verification.Keyring != "" {
+			if c.signatory, err = provenance.NewFromKeyring(verification.Keyring, ""); err != nil {
+				return nil, fmt.Errorf("failed to load keyring %s: %v", verification.Keyring, err)
+			}
+		}
+	}
+	if c.mirrors, err = newMirrorRules(options.Mirrors); err != nil {
+		return nil, err
+	}
+	c.cache = o.cache
+	if c.cache == nil {
+		if c.cache, err = NewChartCache(options.Cache); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// shareTransport defaults the proxy and transport options to the ones of http.
+func shareTransport(proxy **ProxyOptions, transport **TransportOptions, httpOptions *HttpDownloaderOptions) {
+	if *proxy == nil {
+		*proxy = httpOptions.Proxy
+	}
+	if *transport == nil {
+		*transport = httpOptions.Transport
+	}
+}
+
+// Cache returns the chart cache, which is nil if the cache is disabled.
+func (c *ChartDownloader) Cache() *ChartCache {
+	return c.cache
+}
+
+// Download returns the content of the URI in memory, use DownloadTo or DownloadToFile for large charts.
+func (c *ChartDownloader) Download(ctx context.Context, uri string, opts ...DownloadOption) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := c.DownloadTo(ctx, uri, buf, opts...); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// DownloadTo streams the content of the URI to w. The charts to be verified are written to w only
+// after they are downloaded and verified. The cached charts are written to w without downloading.
+// The URI is rewritten by the mirror rules, whose mirrors are tried in order.
+func (c *ChartDownloader) DownloadTo(ctx context.Context, uri string, w io.Writer, opts ...DownloadOption) error {
+	o := &downloadOptions{digest: c.digests[uri]}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if len(o.hosts) > 0 {
+		ctx = context.WithValue(ctx, hostOptionsKey{}, o.hosts)
+	}
+	candidates := c.rewrite(uri)
+	cache := c.cacheOf(uri)
+	if cache != nil && !c.verifiesSignature(uri, candidates) {
+		if data, ok := cache.Get(uri, o.digest); ok {
+			_, err := w.Write(data)
+			return err
+		}
+	}
+	// the cosign signature required by the URI is verified by the OCIDownloader, so that the mirrors of
+	// other schemes, e.g. an https mirror of an oci:// chart, would skip it and are rejected instead
+	requiresCosign := c.verifiesCosign(uri)
+	download := func(candidate string, w io.Writer) error {
+		if requiresCosign && !c.verifiesCosign(candidate) {
+			return &VerificationError{Err: fmt.Errorf("mirror %s of %s can't verify the required cosign signature", RedactURL(candidate), RedactURL(uri))}
+		}
+		return c.download(ctx, candidate, w, o.digest)
+	}
+	if cache == nil && len(candidates) == 1 {
+		return download(candidates[0], w)
+	}
+
+	buf, err := c.fromMirrors(ctx, uri, candidates, func(candidate string, buf *bytes.Buffer) error {
+		return download(candidate, buf)
+	})
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		cache.Put(uri, buf.Bytes())
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
 }
 
-func (c *ChartDownloader) Download(uri string) (*bytes.Buffer, error) {
+// cachedSchemes are the schemes of the remote charts, the charts from files and in-cluster objects may
+// change at any time and are never cached.
+var cachedSchemes = []string{"http", "https", "oci", "s3"}
+
+// cacheOf returns the cache of the URI, which is nil if the chart of the URI is never cached.
+func (c *ChartDownloader) cacheOf(uri string) *ChartCache {
+	if c.cache == nil {
+		return nil
+	}
 	u, err := url.Parse(uri)
 	if err != nil {
-		return nil, err
+		return nil
+	}
+	for _, scheme := range cachedSchemes {
+		if u.Scheme == scheme {
+			return c.cache
+		}
+	}
+	return nil
+}
+
+// verifiesSignature reports whether the chart of the URI or any candidate is verified by its signature, i.e. by
+// the keyring or cosign. The cache doesn't record the signatures an archive was verified by, so that the charts
+// are downloaded and verified again instead of served from the cache, which may be filled without verifiers.
+func (c *ChartDownloader) verifiesSignature(uri string, candidates []string) bool {
+	if c.signatory != nil || c.verifiesCosign(uri) {
+		return true
+	}
+	for _, candidate := range candidates {
+		if c.verifiesCosign(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiesCosign reports whether the chart of the URI is pulled by an OCIDownloader verifying cosign signatures.
+func (c *ChartDownloader) verifiesCosign(uri string) bool {
+	downloader, err := c.downloaderOf(uri)
+	oci, ok := downloader.(*OCIDownloader)
+	return err == nil && ok && oci.cosign != nil
+}
+
+// fromMirrors downloads the candidates of the URI in order until a download succeeds, the content is
+// buffered so that a failed mirror never writes partial content.
+func (c *ChartDownloader) fromMirrors(ctx context.Context, uri string, candidates []string, download func(candidate string, buf *bytes.Buffer) error) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(nil)
+	var errs []error
+	for i, candidate := range candidates {
+		buf.Reset()
+		err := download(candidate, buf)
+		if err == nil {
+			break
+		}
+		if len(candidates) == 1 || ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, err)
+		if i == len(candidates)-1 {
+			return nil, &mirrorsError{uri: uri, errs: errs}
+		}
+		klog.Warningf("failed to download %s from mirror %s, trying the next one: %v", RedactURL(uri), RedactURL(candidate), err)
+	}
+	return buf, nil
+}
+
+// mirrorsError is the error of a URI failing on all its mirrors, which unwraps to the error of each mirror
+// so that e.g. a VerificationError of any mirror is still reported as such.
+type mirrorsError struct {
+	uri  string
+	errs []error
+}
+
+func (e *mirrorsError) Error() string {
+	msgs := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("failed to download %s from all mirrors: %s", RedactURL(e.uri), strings.Join(msgs, "; "))
+}
+
+func (e *mirrorsError) Unwrap() []error {
+	return e.errs
+}
+
+func (c *ChartDownloader) download(ctx context.Context, uri string, w io.Writer, digest string) error {
+	downloader, err := c.downloaderOf(uri)
+	if err != nil {
+		return err
+	}
+	if digest == "" && c.signatory == nil {
+		return downloader.Get(ctx, uri, w)
+	}
+	return c.verifiedDownload(ctx, downloader, uri, w, digest)
+}
+
+func (c *ChartDownloader) downloaderOf(uri string) (Downloader, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart URL %s", RedactURL(uri))
 	}
 	if u.Scheme == "" {
 		u.Scheme = "file"
 	}
 	for _, downloader := range c.downloader {
 		if downloader.Provides(u.Scheme) {
-			return downloader.Get(uri)
+			return downloader, nil
 		}
 	}
-	return c.defaultDownloader.Get(uri)
+	return nil, fmt.Errorf("unsupported scheme %s of chart URL %s", u.Scheme, RedactURL(uri))
 }
 
-func (c *ChartDownloader) DownloadByNameVersion(chartName, chartVersion string) (*bytes.Buffer, error) {
-	scheme := c.globalRegistryUrl.Scheme
-	if scheme == "" {
-		scheme = "file"
+// DownloadToFile downloads the URI to a temporary file and returns its path, the caller should remove
+// the file once it is not needed.
+func (c *ChartDownloader) DownloadToFile(ctx context.Context, uri string, opts ...DownloadOption) (string, error) {
+	f, err := os.CreateTemp("", "chart-*.tgz")
+	if err != nil {
+		return "", err
 	}
-	var subPath string
-	if scheme == "oci" {
-		subPath = fmt.Sprintf("/%s:%s", chartName, chartVersion)
-	} else {
-		subPath = fmt.Sprintf("/%s-%s.tgz", chartName, chartVersion)
+	err = c.DownloadTo(ctx, uri, f, opts...)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
 
-	chartUri := strings.TrimRight(c.globalRegistryUrl.String(), "/") + subPath
+// DownloadByNameVersion downloads the chart from the global registry, the version of the charts in a Helm
+// repository can be a constraint, e.g. `~1.2`, which is resolved by the index of the repository.
+func (c *ChartDownloader) DownloadByNameVersion(ctx context.Context, chartName, chartVersion string) (*bytes.Buffer, error) {
+	chartUri, digest, err := c.ResolveChart(ctx, chartName, chartVersion)
+	if err != nil {
+		return nil, err
+	}
+	var opts []DownloadOption
+	if digest != "" {
+		opts = append(opts, WithDigest(digest))
+	}
+	return c.Download(ctx, chartUri, opts...)
+}
+
+// DownloadResult is the result of a URI downloaded by DownloadAll.
+type DownloadResult struct {
+	URI  string
+	Data *bytes.Buffer
+	Err  error
+}
 
-	return c.Download(chartUri)
+// DownloadAll downloads the URIs in parallel by at most concurrency workers, which defaults to 4.
+// The results are in the same order as the URIs, a failed download doesn't stop the others.
+func (c *ChartDownloader) DownloadAll(ctx context.Context, uris []string, concurrency int) []DownloadResult {
+	if concurrency <= 0 {
+		concurrency = defaultDownloadConcurrency
+	}
+	results := make([]DownloadResult, len(uris))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(concurrency, len(uris)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				data, err := c.Download(ctx, uris[index])
+				results[index] = DownloadResult{URI: uris[index], Data: data, Err: err}
+			}
+		}()
+	}
+	for i := range uris {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
 }
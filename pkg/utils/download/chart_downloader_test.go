@@ -1,18 +1,239 @@
 package download
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart/loader"
 )
 
 func TestChartDownloaderDownload(t *testing.T) {
-	chartDownloader, err := NewChartDownloader(NewDefaultOptions())
-	assert.Equal(t, err, nil)
-	_, err = chartDownloader.Download("../../bin/redis-17.0.1.tgz")
-	assert.Equal(t, err, nil)
-	_, err = chartDownloader.Download("https://charts.kubesphere.io/test/ks-core-0.6.12.tgz")
-	assert.Equal(t, err, nil)
-	_, err = chartDownloader.Download("oci://hub.kubesphere.com.cn/kse-extensions/whizard-monitoring:1.0.0-rc.4")
-	assert.Equal(t, err, nil)
+	archive := testChartArchive(t, "devops", "1.2.0")
+	path := filepath.Join(t.TempDir(), "devops-1.2.0.tgz")
+	require.NoError(t, os.WriteFile(path, archive, 0o644))
+
+	ca := newTestCA(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(archive)
+	}))
+	ca.startTLS(t, server)
+	reg := newTestRegistry(t, false, "admin", "secret")
+	reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+	s3Server := newTestS3Server(t, "minio", "minio123", "")
+	s3Server.objects["charts/devops-1.2.0.tgz"] = archive
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		HttpOptions: &HttpDownloaderOptions{
+			CaBundle: base64.StdEncoding.EncodeToString(ca.certPEM),
+			Hosts:    map[string]HttpHostOptions{server.Listener.Addr().String(): {Username: "admin", Password: "secret"}},
+		},
+		OCIOptions: &OCIDownloaderOptions{PlainHTTP: true, Username: "admin", Password: "secret"},
+		S3Options: &S3DownloaderOptions{
+			Endpoint:        s3Server.URL,
+			PathStyle:       true,
+			AccessKeyID:     "minio",
+			SecretAccessKey: "minio123",
+			CaFile:          s3Server.caFile(t),
+		},
+		Cache: &CacheOptions{Disabled: true},
+	}, WithConfigMapGetter(func(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+		return map[string][]byte{"devops-1.2.0.tgz": archive}, nil
+	}))
+	require.NoError(t, err)
+
+	for _, uri := range []string{
+		path,
+		"file://" + path,
+		server.URL + "/charts/devops-1.2.0.tgz",
+		"oci://" + reg.host() + "/extensions/devops:1.2.0",
+		"s3://charts/devops-1.2.0.tgz",
+		"configmap://kubesphere-system/charts/devops-1.2.0.tgz",
+	} {
+		buf, err := chartDownloader.Download(context.Background(), uri)
+		require.NoError(t, err, uri)
+		ch, err := loader.LoadArchive(buf)
+		require.NoError(t, err, uri)
+		assert.Equal(t, "devops", ch.Name(), uri)
+		assert.Equal(t, "1.2.0", ch.Metadata.Version, uri)
+	}
+
+	_, err = chartDownloader.Download(context.Background(), "ftp://charts.local/devops-1.2.0.tgz")
+	assert.ErrorContains(t, err, "unsupported scheme ftp")
+}
+
+func TestChartDownloaderDownloadAll(t *testing.T) {
+	var inflight, maxInflight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			max := maxInflight.Load()
+			if n <= max || maxInflight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if r.URL.Path == "/missing.tgz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "", "")
+	reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		HttpOptions: &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+		OCIOptions:  &OCIDownloaderOptions{PlainHTTP: true},
+	})
+	require.NoError(t, err)
+
+	var uris []string
+	for i := 0; i < 20; i++ {
+		uris = append(uris, fmt.Sprintf("%s/chart-%d.tgz", server.URL, i))
+	}
+	uris = append(uris, server.URL+"/missing.tgz", "oci://"+reg.host()+"/extensions/devops:1.2.0", "oci://"+reg.host()+"/extensions/devops:1.2.0")
+
+	results := chartDownloader.DownloadAll(context.Background(), uris, 3)
+	require.Len(t, results, len(uris))
+	for i, result := range results[:20] {
+		assert.Equal(t, uris[i], result.URI)
+		require.NoError(t, result.Err)
+		assert.Equal(t, fmt.Sprintf("/chart-%d.tgz", i), result.Data.String())
+	}
+	assert.Error(t, results[20].Err)
+	for _, result := range results[21:] {
+		require.NoError(t, result.Err)
+		assert.Equal(t, archive, result.Data.Bytes())
+	}
+	assert.LessOrEqual(t, maxInflight.Load(), int32(3))
+	assert.Greater(t, maxInflight.Load(), int32(1))
+
+	assert.Empty(t, chartDownloader.DownloadAll(context.Background(), nil, 0))
+}
+
+func TestChartDownloaderDownloadToFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.tgz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("chart"))
+	}))
+	defer server.Close()
+
+	chartDownloader, err := NewChartDownloader(&Options{})
+	require.NoError(t, err)
+	path, err := chartDownloader.DownloadToFile(context.Background(), server.URL+"/redis-17.0.1.tgz")
+	require.NoError(t, err)
+	defer os.Remove(path)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "chart", string(data))
+
+	_, err = chartDownloader.DownloadToFile(context.Background(), server.URL+"/missing.tgz")
+	assert.Error(t, err)
+}
+
+// testDownloader serves the URIs of its schemes from memory.
+type testDownloader struct {
+	schemes []string
+	data    map[string]string
+}
+
+func (d *testDownloader) Get(_ context.Context, uri string, w io.Writer) error {
+	data, ok := d.data[uri]
+	if !ok {
+		return fmt.Errorf("%s not found", uri)
+	}
+	_, err := io.WriteString(w, data)
+	return err
+}
+
+func (d *testDownloader) Provides(scheme string) bool {
+	for _, s := range d.schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChartDownloaderWithDownloader(t *testing.T) {
+	chartDownloader, err := NewChartDownloader(&Options{},
+		WithDownloader(&testDownloader{schemes: []string{"memory", "https"}, data: map[string]string{
+			"memory://devops-1.2.0.tgz":             "devops",
+			"https://charts.local/devops-1.2.0.tgz": "overridden",
+		}}),
+		WithDownloader(&testDownloader{schemes: []string{"memory"}, data: map[string]string{
+			"memory://devops-1.2.0.tgz": "latest",
+		}}),
+	)
+	require.NoError(t, err)
+
+	buf, err := chartDownloader.Download(context.Background(), "memory://devops-1.2.0.tgz")
+	require.NoError(t, err)
+	assert.Equal(t, "latest", buf.String())
+	buf, err = chartDownloader.Download(context.Background(), "https://charts.local/devops-1.2.0.tgz")
+	require.NoError(t, err)
+	assert.Equal(t, "overridden", buf.String())
+
+	_, err = chartDownloader.Download(context.Background(), "ftp://charts.local/devops-1.2.0.tgz")
+	assert.EqualError(t, err, "unsupported scheme ftp of chart URL ftp://charts.local/devops-1.2.0.tgz")
+}
+
+func TestChartDownloaderSharedProxy(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	// the registry serves the requests proxied to it by their paths
+	reg := newTestRegistry(t, false, "", "")
+	reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+	reg.pushChart(t, "charts/devops-1.2.0.tgz", "", archive)
+	reg.blobs["sha256:s3"] = archive
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Host)
+		if r.Host == "minio.invalid" {
+			_, _ = w.Write(archive)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		HttpOptions: &HttpDownloaderOptions{
+			Proxy:     &ProxyOptions{HTTPProxy: proxy.URL},
+			Transport: &TransportOptions{MaxIdleConnsPerHost: 1},
+			Retry:     &RetryOptions{MaxAttempts: 1},
+		},
+		OCIOptions: &OCIDownloaderOptions{PlainHTTP: true, Retry: &RetryOptions{MaxAttempts: 1}},
+		S3Options:  &S3DownloaderOptions{Endpoint: "http://minio.invalid", PathStyle: true, Retry: &RetryOptions{MaxAttempts: 1}},
+	})
+	require.NoError(t, err)
+
+	for _, uri := range []string{"oci://registry.invalid/extensions/devops:1.2.0", "s3://charts/devops-1.2.0.tgz"} {
+		buf, err := chartDownloader.Download(context.Background(), uri)
+		require.NoError(t, err, uri)
+		assert.Equal(t, archive, buf.Bytes(), uri)
+	}
+	assert.Contains(t, proxied, "registry.invalid")
+	assert.Contains(t, proxied, "minio.invalid")
 }
@@ -0,0 +1,110 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ConfigMapGetter returns the data of the ConfigMap, including both data and binaryData.
+type ConfigMapGetter func(ctx context.Context, namespace, name string) (map[string][]byte, error)
+
+// ExtensionChartGetter returns the chart archive of the ExtensionVersion of the extension.
+type ExtensionChartGetter func(ctx context.Context, name, version string) ([]byte, error)
+
+var (
+	configMapDefaultSchemes = []string{"configmap"}
+	secretDefaultSchemes    = []string{"secret"}
+	extensionDefaultSchemes = []string{"extension"}
+)
+
+// ObjectDownloader gets the charts stored in the keys of ConfigMaps or Secrets by the URIs in the form of
+// `configmap://<namespace>/<name>/<key>` and `secret://<namespace>/<name>/<key>`.
+type ObjectDownloader struct {
+	kind    string
+	getter  func(ctx context.Context, namespace, name string) (map[string][]byte, error)
+	Schemes []string
+}
+
+func NewConfigMapDownloader(getter ConfigMapGetter) *ObjectDownloader {
+	return &ObjectDownloader{kind: "configmap", getter: getter, Schemes: configMapDefaultSchemes}
+}
+
+func NewSecretDownloader(getter SecretGetter) *ObjectDownloader {
+	return &ObjectDownloader{kind: "secret", getter: getter, Schemes: secretDefaultSchemes}
+}
+
+func (o *ObjectDownloader) Get(ctx context.Context, uri string, w io.Writer) error {
+	if o.getter == nil {
+		return errors.Errorf("%s charts require access to %ss", o.kind, o.kind)
+	}
+	_, ref, _ := strings.Cut(uri, "://")
+	parts := strings.SplitN(ref, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return errors.Errorf("invalid %s chart URI %s, expected %s://<namespace>/<name>/<key>", o.kind, uri, o.kind)
+	}
+	namespace, name, key := parts[0], parts[1], parts[2]
+	data, err := o.getter(ctx, namespace, name)
+	if err != nil {
+		return errors.Errorf("failed to get %s %s/%s: %v", o.kind, namespace, name, err)
+	}
+	value, ok := data[key]
+	if !ok {
+		return errors.Errorf("key %s not found in %s %s/%s", key, o.kind, namespace, name)
+	}
+	_, err = w.Write(value)
+	return err
+}
+
+func (o *ObjectDownloader) Provides(scheme string) bool {
+	for _, i := range o.Schemes {
+		if scheme == i {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtensionDownloader gets the charts of ExtensionVersions by the URIs in the form of `extension://<name>@<version>`.
+type ExtensionDownloader struct {
+	getter  ExtensionChartGetter
+	Schemes []string
+}
+
+func NewExtensionDownloader(getter ExtensionChartGetter) *ExtensionDownloader {
+	return &ExtensionDownloader{getter: getter, Schemes: extensionDefaultSchemes}
+}
+
+func (e *ExtensionDownloader) Get(ctx context.Context, uri string, w io.Writer) error {
+	if e.getter == nil {
+		return errors.New("extension charts require access to extensionVersions")
+	}
+	_, ref, _ := strings.Cut(uri, "://")
+	name, version, _ := strings.Cut(ref, "@")
+	if name == "" || version == "" {
+		return errors.Errorf("invalid extension chart URI %s, expected extension://<name>@<version>", uri)
+	}
+	data, err := e.getter(ctx, name, version)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (e *ExtensionDownloader) Provides(scheme string) bool {
+	for _, i := range e.Schemes {
+		if scheme == i {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtensionChartURI returns the URI of the chart of the extension version.
+func ExtensionChartURI(name, version string) string {
+	return fmt.Sprintf("%s://%s@%s", extensionDefaultSchemes[0], name, version)
+}
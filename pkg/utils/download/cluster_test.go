@@ -0,0 +1,63 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChartDownloaderClusterCharts(t *testing.T) {
+	objects := map[string]map[string][]byte{
+		"kubesphere-system/devops-chart": {"chart.tgz": []byte("devops")},
+	}
+	getter := func(_ context.Context, namespace, name string) (map[string][]byte, error) {
+		data, ok := objects[namespace+"/"+name]
+		if !ok {
+			return nil, fmt.Errorf("%s/%s not found", namespace, name)
+		}
+		return data, nil
+	}
+	chartDownloader, err := NewChartDownloader(&Options{},
+		WithConfigMapGetter(getter),
+		WithSecretGetter(getter),
+		WithExtensionChartGetter(func(_ context.Context, name, version string) ([]byte, error) {
+			if name != "devops" || version != "1.2.0" {
+				return nil, fmt.Errorf("extensionVersion %s-%s not found", name, version)
+			}
+			return []byte("devops-1.2.0"), nil
+		}),
+	)
+	require.NoError(t, err)
+
+	for uri, expected := range map[string]string{
+		"configmap://kubesphere-system/devops-chart/chart.tgz": "devops",
+		"secret://kubesphere-system/devops-chart/chart.tgz":    "devops",
+		ExtensionChartURI("devops", "1.2.0"):                   "devops-1.2.0",
+	} {
+		buf, err := chartDownloader.Download(context.Background(), uri)
+		require.NoError(t, err, uri)
+		assert.Equal(t, expected, buf.String(), uri)
+	}
+
+	for uri, expected := range map[string]string{
+		"configmap://kubesphere-system/devops-chart":        "invalid configmap chart URI",
+		"configmap://kubesphere-system/devops-chart/values": "key values not found in configmap kubesphere-system/devops-chart",
+		"secret://kubesphere-system/missing/chart.tgz":      "failed to get secret kubesphere-system/missing",
+		"extension://devops":                                "invalid extension chart URI",
+		"extension://devops@1.3.0":                          "extensionVersion devops-1.3.0 not found",
+	} {
+		err := chartDownloader.DownloadTo(context.Background(), uri, io.Discard)
+		assert.ErrorContains(t, err, expected, uri)
+	}
+
+	chartDownloader, err = NewChartDownloader(&Options{})
+	require.NoError(t, err)
+	err = chartDownloader.DownloadTo(context.Background(), "configmap://kubesphere-system/devops-chart/chart.tgz", io.Discard)
+	assert.ErrorContains(t, err, "configmap charts require access to configmaps")
+	err = chartDownloader.DownloadTo(context.Background(), ExtensionChartURI("devops", "1.2.0"), io.Discard)
+	assert.ErrorContains(t, err, "extension charts require access to extensionVersions")
+}
@@ -0,0 +1,341 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"oras.land/oras-go/pkg/registry/remote/auth"
+)
+
+const (
+	// cosignSignatureMediaType is the media type of the layers of cosign signature manifests.
+	cosignSignatureMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// cosignSignatureAnnotation holds the base64 encoded signature of the layer.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// cosignBundleAnnotation holds the offline Rekor bundle of the layer.
+	cosignBundleAnnotation = "dev.sigstore.cosign/bundle"
+	cosignSignatureType    = "cosign container image signature"
+
+	// maxSignatureSize limits the size of the signature manifests and payloads.
+	maxSignatureSize = 4 << 20
+)
+
+// CosignOptions configures the verification of cosign signatures, the signature of a chart is pulled from
+// the tag `sha256-<hex>.sig` of its repository the same way as `cosign verify --key`.
+type CosignOptions struct {
+	// PublicKey is the PEM encoded public key of the signer, PublicKeyFile is the path of it.
+	PublicKey     string `json:"publicKey,omitempty" yaml:"publicKey,omitempty"`
+	PublicKeyFile string `json:"publicKeyFile,omitempty" yaml:"publicKeyFile,omitempty"`
+	// RekorPublicKey is the PEM encoded public key of the Rekor transparency log, RekorPublicKeyFile is the path
+	// of it. Once set, the signatures require offline bundles, whose signed entry timestamps are verified.
+	RekorPublicKey     string `json:"rekorPublicKey,omitempty" yaml:"rekorPublicKey,omitempty"`
+	RekorPublicKeyFile string `json:"rekorPublicKeyFile,omitempty" yaml:"rekorPublicKeyFile,omitempty"`
+}
+
+// CosignVerifier verifies cosign signatures of OCI artifacts against a public key without network
+// access to the transparency log.
+type CosignVerifier struct {
+	publicKey      crypto.PublicKey
+	rekorPublicKey crypto.PublicKey
+	rekorLogID     string
+}
+
+func NewCosignVerifier(options *CosignOptions) (*CosignVerifier, error) {
+	data, err := readPEM(options.PublicKey, options.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("publicKey or publicKeyFile is required")
+	}
+	v := &CosignVerifier{}
+	if v.publicKey, _, err = parsePublicKey(data); err != nil {
+		return nil, errors.Errorf("invalid public key: %v", err)
+	}
+
+	data, err = readPEM(options.RekorPublicKey, options.RekorPublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		var der []byte
+		if v.rekorPublicKey, der, err = parsePublicKey(data); err != nil {
+			return nil, errors.Errorf("invalid rekor public key: %v", err)
+		}
+		sum := sha256.Sum256(der)
+		v.rekorLogID = hex.EncodeToString(sum[:])
+	}
+	return v, nil
+}
+
+func readPEM(content, file string) ([]byte, error) {
+	if content != "" {
+		return []byte(content), nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Errorf("failed to read %s: %v", file, err)
+	}
+	return data, nil
+}
+
+// parsePublicKey returns the public key and its DER encoding.
+func parsePublicKey(data []byte) (crypto.PublicKey, []byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, block.Bytes, nil
+}
+
+// verifySignature verifies the signature of the payload signed with SHA-256.
+func verifySignature(key crypto.PublicKey, payload, signature []byte) error {
+	digest := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.Errorf("unsupported public key type %T", key)
+	}
+	return nil
+}
+
+type ociManifest struct {
+	Layers []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"layers"`
+}
+
+// simpleSigning is the payload signed by cosign.
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// rekorBundle is the offline bundle of a Rekor log entry.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte       `json:"SignedEntryTimestamp"`
+	Payload              rekorPayload `json:"Payload"`
+}
+
+// rekorPayload is signed by the signed entry timestamp in its canonical JSON form, i.e. sorted keys
+// without spaces, which is the form the fields are marshalled in.
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of the Rekor log entry of a signature.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content []byte `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// Verify verifies the cosign signature manifest of the manifest digest, blob returns the content of a
+// blob of the repository. The manifest is verified once any of its signatures is verified.
+func (v *CosignVerifier) Verify(manifestDigest string, signatures []byte, blob func(digest string) ([]byte, error)) error {
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(signatures, manifest); err != nil {
+		return errors.Errorf("invalid signature manifest: %v", err)
+	}
+	err := errors.New("no signature layer found")
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != cosignSignatureMediaType {
+			continue
+		}
+		var payload []byte
+		if payload, err = blob(layer.Digest); err != nil {
+			return err
+		}
+		if err = VerifyDigest(payload, layer.Digest); err != nil {
+			continue
+		}
+		if err = v.verifyLayer(manifestDigest, payload, layer.Annotations); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (v *CosignVerifier) verifyLayer(manifestDigest string, payload []byte, annotations map[string]string) error {
+	signature, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil || len(signature) == 0 {
+		return errors.New("no signature found in the signature layer")
+	}
+	if err := verifySignature(v.publicKey, payload, signature); err != nil {
+		return err
+	}
+
+	signing := &simpleSigning{}
+	if err := json.Unmarshal(payload, signing); err != nil {
+		return errors.Errorf("invalid signature payload: %v", err)
+	}
+	if signing.Critical.Type != cosignSignatureType {
+		return errors.Errorf("unexpected signature type %q", signing.Critical.Type)
+	}
+	if signing.Critical.Image.DockerManifestDigest != manifestDigest {
+		return errors.Errorf("signature is for %s instead of %s", signing.Critical.Image.DockerManifestDigest, manifestDigest)
+	}
+
+	if v.rekorPublicKey == nil {
+		return nil
+	}
+	bundle, ok := annotations[cosignBundleAnnotation]
+	if !ok {
+		return errors.New("no rekor bundle found in the signature layer")
+	}
+	return v.verifyBundle([]byte(bundle), payload, signature)
+}
+
+// verifyBundle verifies that the bundle is signed by Rekor and records the signature of the payload.
+func (v *CosignVerifier) verifyBundle(data, payload, signature []byte) error {
+	bundle := &rekorBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return errors.Errorf("invalid rekor bundle: %v", err)
+	}
+	if bundle.Payload.LogID != v.rekorLogID {
+		return errors.Errorf("rekor bundle is from log %s instead of %s", bundle.Payload.LogID, v.rekorLogID)
+	}
+	canonical, err := json.Marshal(bundle.Payload)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(v.rekorPublicKey, canonical, bundle.SignedEntryTimestamp); err != nil {
+		return errors.Errorf("invalid signed entry timestamp of rekor bundle: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return errors.Errorf("invalid rekor bundle body: %v", err)
+	}
+	entry := &hashedRekord{}
+	if err := json.Unmarshal(body, entry); err != nil {
+		return errors.Errorf("invalid rekor bundle body: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	if entry.Kind != "hashedrekord" || entry.Spec.Data.Hash.Algorithm != "sha256" ||
+		entry.Spec.Data.Hash.Value != hex.EncodeToString(sum[:]) || !bytes.Equal(entry.Spec.Signature.Content, signature) {
+		return errors.New("rekor bundle doesn't record the signature")
+	}
+	return nil
+}
+
+// verifyCosignSignature pulls the signature manifest of the reference from its repository and verifies it.
+func (o *OCIDownloader) verifyCosignSignature(ctx context.Context, host, ref, manifestDigest string) error {
+	repository := ociRepository(ref)
+	transport, err := o.transport(host)
+	if err != nil {
+		return err
+	}
+	client := &auth.Client{
+		Client: &http.Client{Transport: &retryTransport{base: transport, retrier: o.retrier}},
+		Cache:  auth.NewCache(),
+		Credential: func(ctx context.Context, _ string) (auth.Credential, error) {
+			cred, _, err := o.credential(ctx, host)
+			return auth.Credential{Username: cred.username, Password: cred.password}, err
+		},
+	}
+	ctx = auth.WithScopes(ctx, auth.ScopeRepository(repository, "pull"))
+	scheme := "https"
+	if o.plainHTTP(host) {
+		scheme = "http"
+	}
+	fetch := func(path, accept string) ([]byte, bool, error) {
+		uri := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, host, repository, path)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, false, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, false, newStatusError(uri, resp)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+		return data, true, err
+	}
+
+	tag := strings.Replace(manifestDigest, ":", "-", 1) + ".sig"
+	signatures, ok, err := fetch("manifests/"+tag, "application/vnd.oci.image.manifest.v1+json")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("no signature found at %s:%s", repository, tag)
+	}
+	return o.cosign.Verify(manifestDigest, signatures, func(digest string) ([]byte, error) {
+		data, ok, err := fetch("blobs/"+digest, "*/*")
+		if err == nil && !ok {
+			err = errors.Errorf("blob %s not found", digest)
+		}
+		return data, err
+	})
+}
+
+// ociRepository returns the repository of the reference, e.g. `harbor.local/library/devops:1.2.0` -> `library/devops`.
+func ociRepository(ref string) string {
+	ref, _, _ = strings.Cut(ref, "@")
+	_, repository, _ := strings.Cut(ref, "/")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return repository
+}
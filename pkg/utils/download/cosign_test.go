@@ -0,0 +1,242 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+// testSigner signs payloads the same way as cosign, optionally with Rekor bundles.
+type testSigner struct {
+	key      *ecdsa.PrivateKey
+	rekorKey *ecdsa.PrivateKey
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &testSigner{key: key, rekorKey: rekorKey}
+}
+
+func testPublicKeyPEM(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func (s *testSigner) sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) []byte {
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	return signature
+}
+
+// bundle returns the Rekor bundle recording the signature of the payload.
+func (s *testSigner) bundle(t *testing.T, payload, signature []byte) string {
+	sum := sha256.Sum256(payload)
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"data":      map[string]interface{}{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(sum[:])}},
+			"signature": map[string]interface{}{"content": signature},
+		},
+	})
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&s.rekorKey.PublicKey)
+	require.NoError(t, err)
+	logID := sha256.Sum256(der)
+	rekorPayload := rekorPayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: 1700000000,
+		LogID:          hex.EncodeToString(logID[:]),
+		LogIndex:       42,
+	}
+	canonical, err := json.Marshal(rekorPayload)
+	require.NoError(t, err)
+	data, err := json.Marshal(rekorBundle{SignedEntryTimestamp: s.sign(t, s.rekorKey, canonical), Payload: rekorPayload})
+	require.NoError(t, err)
+	return string(data)
+}
+
+// signatureManifest returns the cosign signature manifest of the manifest digest, whose blobs are added to the registry.
+func (s *testSigner) signatureManifest(t *testing.T, reg *testRegistry, repo, manifestDigest string, withBundle bool) []byte {
+	payload, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": reg.host() + "/" + repo},
+			"image":    map[string]string{"docker-manifest-digest": manifestDigest},
+			"type":     cosignSignatureType,
+		},
+		"optional": nil,
+	})
+	require.NoError(t, err)
+	signature := s.sign(t, s.key, payload)
+	annotations := map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)}
+	if withBundle {
+		annotations[cosignBundleAnnotation] = s.bundle(t, payload, signature)
+	}
+
+	config := []byte("{}")
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        testDescriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: reg.addBlob(config), Size: len(config)},
+		"layers": []testDescriptor{
+			{MediaType: cosignSignatureMediaType, Digest: reg.addBlob(payload), Size: len(payload), Annotations: annotations},
+		},
+	})
+	require.NoError(t, err)
+	return manifest
+}
+
+func cosignTag(manifestDigest string) string {
+	return strings.Replace(manifestDigest, ":", "-", 1) + ".sig"
+}
+
+func TestOCIDownloaderCosign(t *testing.T) {
+	signer := newTestSigner(t)
+	other := newTestSigner(t)
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "admin", "secret")
+
+	signed := reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+	reg.pushManifest("extensions/devops", cosignTag(signed), signer.signatureManifest(t, reg, "extensions/devops", signed, false))
+	bundled := reg.pushChart(t, "extensions/bundled", "1.2.0", archive)
+	reg.pushManifest("extensions/bundled", cosignTag(bundled), signer.signatureManifest(t, reg, "extensions/bundled", bundled, true))
+	reg.pushChart(t, "extensions/unsigned", "1.2.0", archive)
+	// the signature of another chart is copied to the signature tag of the chart
+	copied := reg.pushChart(t, "extensions/copied", "1.2.0", testChartArchive(t, "copied", "1.2.0"))
+	reg.pushManifest("extensions/copied", cosignTag(copied), signer.signatureManifest(t, reg, "extensions/copied", signed, false))
+
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testPublicKeyPEM(t, signer.key)), 0o644))
+
+	tests := []struct {
+		name    string
+		cosign  *CosignOptions
+		repo    string
+		wantErr string
+	}{
+		{name: "signed", cosign: &CosignOptions{PublicKeyFile: keyFile}, repo: "extensions/devops"},
+		{name: "unsigned", cosign: &CosignOptions{PublicKeyFile: keyFile}, repo: "extensions/unsigned", wantErr: "no signature found"},
+		{name: "other key", cosign: &CosignOptions{PublicKey: testPublicKeyPEM(t, other.key)}, repo: "extensions/devops", wantErr: "invalid signature"},
+		{name: "signature of other chart", cosign: &CosignOptions{PublicKeyFile: keyFile}, repo: "extensions/copied", wantErr: "signature is for " + signed},
+		{
+			name:   "bundle",
+			cosign: &CosignOptions{PublicKeyFile: keyFile, RekorPublicKey: testPublicKeyPEM(t, signer.rekorKey)},
+			repo:   "extensions/bundled",
+		},
+		{
+			name:    "bundle required",
+			cosign:  &CosignOptions{PublicKeyFile: keyFile, RekorPublicKey: testPublicKeyPEM(t, signer.rekorKey)},
+			repo:    "extensions/devops",
+			wantErr: "no rekor bundle found",
+		},
+		{
+			name:    "bundle of other log",
+			cosign:  &CosignOptions{PublicKeyFile: keyFile, RekorPublicKey: testPublicKeyPEM(t, other.rekorKey)},
+			repo:    "extensions/bundled",
+			wantErr: "rekor bundle is from log",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewOCIDownloader(&OCIDownloaderOptions{
+				PlainHTTP: true,
+				Username:  "admin",
+				Password:  "secret",
+				Retry:     &RetryOptions{MaxAttempts: 1},
+				Cosign:    tt.cosign,
+			}, nil)
+			require.NoError(t, err)
+			buf := bytes.NewBuffer(nil)
+			err = d.Get(context.Background(), "oci://"+reg.host()+"/"+tt.repo+":1.2.0", buf)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, archive, buf.Bytes())
+		})
+	}
+}
+
+func TestCosignVerifierBundle(t *testing.T) {
+	signer := newTestSigner(t)
+	payload, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"image": map[string]string{"docker-manifest-digest": "sha256:abc"},
+			"type":  cosignSignatureType,
+		},
+	})
+	require.NoError(t, err)
+	signature := signer.sign(t, signer.key, payload)
+	v, err := NewCosignVerifier(&CosignOptions{
+		PublicKey:      testPublicKeyPEM(t, signer.key),
+		RekorPublicKey: testPublicKeyPEM(t, signer.rekorKey),
+	})
+	require.NoError(t, err)
+
+	bundle := signer.bundle(t, payload, signature)
+	assert.NoError(t, v.verifyBundle([]byte(bundle), payload, signature))
+	assert.ErrorContains(t, v.verifyBundle([]byte(bundle), []byte("other"), signature), "doesn't record the signature")
+
+	tampered := &rekorBundle{}
+	require.NoError(t, json.Unmarshal([]byte(bundle), tampered))
+	tampered.Payload.LogIndex++
+	data, err := json.Marshal(tampered)
+	require.NoError(t, err)
+	assert.ErrorContains(t, v.verifyBundle(data, payload, signature), "invalid signed entry timestamp")
+}
+
+func TestCosignOptionsErrors(t *testing.T) {
+	_, err := NewOCIDownloader(&OCIDownloaderOptions{Cosign: &CosignOptions{}}, nil)
+	assert.ErrorContains(t, err, "invalid cosign options: publicKey or publicKeyFile is required")
+	_, err = NewOCIDownloader(&OCIDownloaderOptions{Cosign: &CosignOptions{PublicKey: "invalid"}}, nil)
+	assert.ErrorContains(t, err, "invalid public key")
+	_, err = NewOCIDownloader(&OCIDownloaderOptions{Cosign: &CosignOptions{PublicKeyFile: filepath.Join(t.TempDir(), "missing.pub")}}, nil)
+	assert.ErrorContains(t, err, "failed to read")
+}
+
+func TestOCIRepository(t *testing.T) {
+	assert.Equal(t, "extensions/devops", ociRepository("harbor.local:8443/extensions/devops:1.2.0"))
+	assert.Equal(t, "extensions/devops", ociRepository("harbor.local/extensions/devops:1.2.0@sha256:abc"))
+	assert.Equal(t, "devops", ociRepository("harbor.local/devops@sha256:abc"))
+}
+
+func TestOCIDownloaderCosignProvenance(t *testing.T) {
+	// the provenance isn't signed by cosign, it is verified against the keyring of the ChartDownloader
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "", "")
+	prov := []byte("provenance")
+	reg.pushChart(t, "extensions/devops", "1.2.0", archive,
+		testDescriptor{MediaType: registry.ProvLayerMediaType, Digest: reg.addBlob(prov), Size: len(prov)})
+	d, err := NewOCIDownloader(&OCIDownloaderOptions{
+		PlainHTTP: true,
+		Cosign:    &CosignOptions{PublicKey: testPublicKeyPEM(t, newTestSigner(t).key)},
+	}, nil)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, d.Get(context.Background(), "oci://"+reg.host()+"/extensions/devops:1.2.0.prov", buf))
+	assert.Equal(t, prov, buf.Bytes())
+	assert.Error(t, d.Get(context.Background(), "oci://"+reg.host()+"/extensions/devops:1.2.0", io.Discard))
+}
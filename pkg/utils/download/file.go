@@ -1,8 +1,13 @@
 package download
 
 import (
-	"bytes"
+	"context"
+	"io"
+	"net/url"
 	"os"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 type FileDownloaderOptions struct{}
@@ -19,12 +24,39 @@ func NewFileDownloader(_ *FileDownloaderOptions) *FileDownloader {
 	}
 }
 
-func (f *FileDownloader) Get(uri string) (*bytes.Buffer, error) {
-	data, err := os.ReadFile(uri)
+func (f *FileDownloader) Get(ctx context.Context, uri string, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := filePath(uri)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// filePath returns the local path of the URI, which is either a `file://` URL or a path.
+func filePath(uri string) (string, error) {
+	if !strings.HasPrefix(uri, "file://") {
+		return uri, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.Errorf("invalid file URL %s", uri)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", errors.Errorf("file URL %s refers to remote host %s", uri, u.Host)
+	}
+	if u.Path == "" {
+		return "", errors.Errorf("file URL %s has no path", uri)
 	}
-	return bytes.NewBuffer(data), err
+	return u.Path, nil
 }
 
 func (f *FileDownloader) Provides(scheme string) bool {
@@ -1,13 +1,45 @@
 package download
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFileDownloaderGet(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	path := filepath.Join(t.TempDir(), "devops-1.2.0.tgz")
+	require.NoError(t, os.WriteFile(path, archive, 0o644))
+
+	d := NewFileDownloader(&FileDownloaderOptions{})
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, d.Get(context.Background(), path, buf))
+	assert.Equal(t, archive, buf.Bytes())
+
+	err := d.Get(context.Background(), filepath.Join(filepath.Dir(path), "missing.tgz"), io.Discard)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFileDownloaderFileURL(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "extension charts")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	path := filepath.Join(dir, "devops-1.2.0.tgz")
+	require.NoError(t, os.WriteFile(path, []byte("devops"), 0o644))
+	escaped := (&url.URL{Path: path}).EscapedPath()
+
 	d := NewFileDownloader(&FileDownloaderOptions{})
-	_, err := d.Get("../../bin/redis-17.0.1.tgz")
-	assert.Equal(t, err, nil)
+	for _, uri := range []string{path, "file://" + escaped, "file://localhost" + escaped} {
+		buf := bytes.NewBuffer(nil)
+		require.NoError(t, d.Get(context.Background(), uri, buf), uri)
+		assert.Equal(t, "devops", buf.String(), uri)
+	}
+	assert.ErrorContains(t, d.Get(context.Background(), "file://charts.local"+escaped, io.Discard), "refers to remote host charts.local")
+	assert.ErrorContains(t, d.Get(context.Background(), "file://", io.Discard), "has no path")
 }
@@ -2,16 +2,25 @@ package download
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
@@ -20,111 +29,406 @@ var (
 )
 
 type HttpDownloaderOptions struct {
-	Timeout            int64  `json:"timeout,omitempty" yaml:"timeout,omitempty"`
-	CaBundle           string `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	Timeout  int64  `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	CaBundle string `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	// CaFile is the path of a PEM encoded CA bundle, e.g. mounted from a ConfigMap.
+	CaFile             string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
 	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+	// Hosts contains the credentials and TLS options of specific hosts by host, e.g. `charts.local:8443`,
+	// so that credentials are not embedded in chart URLs.
+	Hosts map[string]HttpHostOptions `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	Retry *RetryOptions              `json:"retry,omitempty" yaml:"retry,omitempty"`
+	// Proxy defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy     *ProxyOptions     `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	Transport *TransportOptions `json:"transport,omitempty" yaml:"transport,omitempty"`
+}
+
+// ProxyOptions overrides the corresponding proxy environment variables.
+type ProxyOptions struct {
+	HTTPProxy  string `json:"httpProxy,omitempty" yaml:"httpProxy,omitempty"`
+	HTTPSProxy string `json:"httpsProxy,omitempty" yaml:"httpsProxy,omitempty"`
+	// NoProxy is a comma-separated list of hosts, domains and CIDRs which are accessed directly,
+	// in the same format as NO_PROXY.
+	NoProxy string `json:"noProxy,omitempty" yaml:"noProxy,omitempty"`
+}
+
+// TransportOptions tunes the connections to chart repositories, the defaults are the same as
+// http.DefaultTransport.
+type TransportOptions struct {
+	DialTimeout         *metav1.Duration `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty"`
+	KeepAlive           *metav1.Duration `json:"keepAlive,omitempty" yaml:"keepAlive,omitempty"`
+	TLSHandshakeTimeout *metav1.Duration `json:"tlsHandshakeTimeout,omitempty" yaml:"tlsHandshakeTimeout,omitempty"`
+	IdleConnTimeout     *metav1.Duration `json:"idleConnTimeout,omitempty" yaml:"idleConnTimeout,omitempty"`
+	MaxIdleConnsPerHost int              `json:"maxIdleConnsPerHost,omitempty" yaml:"maxIdleConnsPerHost,omitempty"`
+	DisableKeepAlives   bool             `json:"disableKeepAlives,omitempty" yaml:"disableKeepAlives,omitempty"`
 }
 
+// Keys of the Secret referred by HttpHostOptions.Secret, which are the keys of kubernetes.io/basic-auth
+// and kubernetes.io/tls Secrets.
+const (
+	SecretUsernameKey = "username"
+	SecretPasswordKey = "password"
+	SecretTokenKey    = "token"
+	SecretTLSCertKey  = "tls.crt"
+	SecretTLSKeyKey   = "tls.key"
+	SecretCAKey       = "ca.crt"
+)
+
+// HttpHostOptions authenticates the requests to a host by basic auth, bearer token or client certificate.
+type HttpHostOptions struct {
+	Username    string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password    string `json:"password,omitempty" yaml:"password,omitempty"`
+	BearerToken string `json:"bearerToken,omitempty" yaml:"bearerToken,omitempty"`
+	// CertFile and KeyFile are the paths of the PEM encoded client certificate and key.
+	CertFile string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	// CaBundle and CaFile override the CA of HttpDownloaderOptions.
+	CaBundle           string `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	CaFile             string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+	InsecureSkipVerify *bool  `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+	// Secret refers to a Secret containing the keys `username` and `password`, `token`, `tls.crt` and
+	// `tls.key`, or `ca.crt`, which take precedence over the fields above. Its Key is ignored. The Secret is
+	// read on the first request to the host.
+	Secret *SecretReference `json:"secret,omitempty" yaml:"secret,omitempty"`
+}
+
+// HttpDownloader is safe for concurrent use, its clients are created on construction except the ones
+// of the hosts with Secrets and of the host options of single downloads, which are created on demand
+// and reused.
 type HttpDownloader struct {
-	timeout            int64
-	insecureSkipVerify bool
-	defaultClient      *http.Client
-	pool               map[string]*http.Client
-	certPool           *x509.CertPool
-	Schemes            []string
+	options      *HttpDownloaderOptions
+	secretGetter SecretGetter
+	timeout      int64
+	transport    *http.Transport
+	// defaultClient is used for the hosts without HttpHostOptions
+	defaultClient *http.Client
+	retrier       *retrier
+	Schemes       []string
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+	hosts   map[string]*httpHost
+	// downloadHosts are the hosts of the options passed by WithHostOptions
+	downloadHosts map[string]*downloadHost
+}
+
+type downloadHost struct {
+	host   *httpHost
+	client *http.Client
 }
 
-func NewHttpDownloader(options *HttpDownloaderOptions) (*HttpDownloader, error) {
-	transport := &http.Transport{}
+type hostOptionsKey struct{}
+
+// WithHostOptions authenticates the requests of a single download to the host by the options, which take
+// precedence over HttpDownloaderOptions.Hosts, e.g. the credentials and CA of the Repository of an
+// ExtensionVersion. The options don't apply to the mirrors of the URI on other hosts.
+func WithHostOptions(host string, options HttpHostOptions) DownloadOption {
+	return func(o *downloadOptions) {
+		if o.hosts == nil {
+			o.hosts = make(map[string]HttpHostOptions)
+		}
+		o.hosts[host] = options
+	}
+}
+
+// httpHost is the resolved HttpHostOptions of a host.
+type httpHost struct {
+	username    string
+	password    string
+	bearerToken string
+	tlsConfig   *tls.Config
+}
+
+func NewHttpDownloader(options *HttpDownloaderOptions, secretGetter SecretGetter) (*HttpDownloader, error) {
+	if options == nil {
+		options = &HttpDownloaderOptions{}
+	}
 	var timeout = defaultHttpTimeout
-	if options != nil && options.Timeout > 0 {
+	if options.Timeout > 0 {
 		timeout = options.Timeout
 	}
-	certPool, err := x509.SystemCertPool()
+	tlsConfig, err := newTLSConfig(options.CaBundle, options.CaFile, options.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(options.Proxy, options.Transport)
 	if err != nil {
 		return nil, err
 	}
-	if options != nil && options.CaBundle != "" {
-		caBundle, err := base64.StdEncoding.DecodeString(options.CaBundle)
+	h := &HttpDownloader{
+		options:       options,
+		secretGetter:  secretGetter,
+		timeout:       timeout,
+		transport:     transport,
+		clients:       make(map[string]*http.Client),
+		hosts:         make(map[string]*httpHost),
+		retrier:       newRetrier(options.Retry),
+		Schemes:       httpDefaultSchemes,
+		downloadHosts: make(map[string]*downloadHost),
+	}
+	h.defaultClient = h.newClient(tlsConfig)
+	for host, hostOptions := range options.Hosts {
+		// the hosts with Secrets are resolved on their first requests, so that a missing Secret only fails
+		// the downloads from its host
+		if hostOptions.Secret != nil {
+			if secretGetter == nil {
+				return nil, errors.Errorf("invalid options of host %s: secret requires access to secrets", host)
+			}
+			continue
+		}
+		if h.hosts[host], err = newHttpHost(context.Background(), options, hostOptions, nil); err != nil {
+			return nil, errors.Errorf("invalid options of host %s: %v", host, err)
+		}
+		h.clients[host] = h.newClient(h.hosts[host].tlsConfig)
+	}
+	return h, nil
+}
+
+// newClient returns a client with its own transport, so that each host with specific TLS options has
+// its own connections.
+func (h *HttpDownloader) newClient(tlsConfig *tls.Config) *http.Client {
+	t := h.transport.Clone()
+	t.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: t, Timeout: time.Second * time.Duration(h.timeout)}
+}
+
+// host returns the resolved options of the host and its client, the hosts with Secrets are resolved on
+// their first requests and resolved again after failures.
+func (h *HttpDownloader) host(ctx context.Context, host string) (*httpHost, *http.Client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if resolved, ok := h.hosts[host]; ok {
+		return resolved, h.clients[host], nil
+	}
+	hostOptions, ok := h.options.Hosts[host]
+	if !ok {
+		return nil, h.defaultClient, nil
+	}
+	resolved, err := newHttpHost(ctx, h.options, hostOptions, h.secretGetter)
+	if err != nil {
+		return nil, nil, errors.Errorf("invalid options of host %s: %v", host, err)
+	}
+	h.hosts[host], h.clients[host] = resolved, h.newClient(resolved.tlsConfig)
+	return resolved, h.clients[host], nil
+}
+
+// downloadHost returns the resolved host options passed by WithHostOptions and its client, which are
+// shared by the downloads with the same options.
+func (h *HttpDownloader) downloadHost(ctx context.Context, host string, hostOptions HttpHostOptions) (*downloadHost, error) {
+	data, err := json.Marshal(hostOptions)
+	if err != nil {
+		return nil, err
+	}
+	key := host + "/" + string(data)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if d, ok := h.downloadHosts[key]; ok {
+		return d, nil
+	}
+	resolved, err := newHttpHost(ctx, h.options, hostOptions, h.secretGetter)
+	if err != nil {
+		return nil, errors.Errorf("invalid options of host %s: %v", host, err)
+	}
+	d := &downloadHost{host: resolved, client: h.newClient(resolved.tlsConfig)}
+	h.downloadHosts[key] = d
+	return d, nil
+}
+
+func newHttpHost(ctx context.Context, options *HttpDownloaderOptions, hostOptions HttpHostOptions, secretGetter SecretGetter) (*httpHost, error) {
+	host := &httpHost{
+		username:    hostOptions.Username,
+		password:    hostOptions.Password,
+		bearerToken: hostOptions.BearerToken,
+	}
+	var certPEM, keyPEM, caPEM []byte
+	if hostOptions.CertFile != "" || hostOptions.KeyFile != "" {
+		if hostOptions.CertFile == "" || hostOptions.KeyFile == "" {
+			return nil, errors.New("certFile and keyFile must be specified together")
+		}
+		var err error
+		if certPEM, err = os.ReadFile(hostOptions.CertFile); err != nil {
+			return nil, errors.Errorf("can't read certFile: %v", err)
+		}
+		if keyPEM, err = os.ReadFile(hostOptions.KeyFile); err != nil {
+			return nil, errors.Errorf("can't read keyFile: %v", err)
+		}
+	}
+
+	if ref := hostOptions.Secret; ref != nil {
+		if secretGetter == nil {
+			return nil, errors.New("secret requires access to secrets")
+		}
+		data, err := secretGetter(ctx, ref.Namespace, ref.Name)
 		if err != nil {
-			return nil, errors.Errorf("can't decode CaBundle: %v", err)
+			return nil, errors.Errorf("failed to get secret %s/%s: %v", ref.Namespace, ref.Name, err)
+		}
+		if username, ok := data[SecretUsernameKey]; ok {
+			host.username, host.password = string(username), string(data[SecretPasswordKey])
+		}
+		if token, ok := data[SecretTokenKey]; ok {
+			host.bearerToken = string(token)
 		}
-		certPool.AppendCertsFromPEM(caBundle)
+		if cert, ok := data[SecretTLSCertKey]; ok {
+			certPEM, keyPEM = cert, data[SecretTLSKeyKey]
+		}
+		caPEM = data[SecretCAKey]
 	}
-	insecureSkipVerify := false
-	if options != nil {
-		insecureSkipVerify = options.InsecureSkipVerify
+	if host.username != "" && host.bearerToken != "" {
+		return nil, errors.New("basic auth and bearer token can't be used together")
 	}
-	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecureSkipVerify, RootCAs: certPool}
 
-	return &HttpDownloader{
-		timeout:            timeout,
-		insecureSkipVerify: insecureSkipVerify,
-		defaultClient: &http.Client{
-			Transport: transport,
-			Timeout:   time.Second * time.Duration(timeout),
-		},
-		pool:     make(map[string]*http.Client),
-		Schemes:  httpDefaultSchemes,
-		certPool: certPool,
-	}, nil
+	caBundle, caFile := options.CaBundle, options.CaFile
+	if hostOptions.CaBundle != "" || hostOptions.CaFile != "" {
+		caBundle, caFile = hostOptions.CaBundle, hostOptions.CaFile
+	}
+	insecureSkipVerify := options.InsecureSkipVerify
+	if hostOptions.InsecureSkipVerify != nil {
+		insecureSkipVerify = *hostOptions.InsecureSkipVerify
+	}
+	tlsConfig, err := newTLSConfig(caBundle, caFile, insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if len(caPEM) > 0 && !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.Errorf("no certificates found in %s of secret", SecretCAKey)
+	}
+	if certPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Errorf("invalid client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	host.tlsConfig = tlsConfig
+	return host, nil
 }
 
-func (h *HttpDownloader) Get(uri string) (*bytes.Buffer, error) {
+func (h *HttpDownloader) Get(ctx context.Context, uri string, w io.Writer) error {
 	u, err := url.Parse(uri)
 	if err != nil {
-		return nil, err
+		return errors.Errorf("invalid URL %s", RedactURL(uri))
 	}
+	var host *httpHost
+	var client *http.Client
+	downloadHosts, _ := ctx.Value(hostOptionsKey{}).(map[string]HttpHostOptions)
+	if hostOptions, ok := downloadHosts[u.Host]; ok {
+		d, err := h.downloadHost(ctx, u.Host, hostOptions)
+		if err != nil {
+			return err
+		}
+		host, client = d.host, d.client
+	} else if host, client, err = h.host(ctx, u.Host); err != nil {
+		return err
+	}
+
+	f := &httpFetch{ctx: ctx, client: client, uri: uri, url: u, host: host, w: w}
+	return h.retrier.do(ctx, f.fetch)
+}
 
-	req, err := http.NewRequest(http.MethodGet, uri, nil)
+// httpFetch streams a URL to w, an interrupted download is resumed by a range request if the
+// server supports ranges and the content can be validated by ETag or Last-Modified.
+type httpFetch struct {
+	ctx    context.Context
+	client *http.Client
+	uri    string
+	url    *url.URL
+	host   *httpHost
+	w      io.Writer
+	// written is the number of bytes written to w
+	written int64
+	// validator is the If-Range value of the written content
+	validator string
+}
+
+func (f *httpFetch) fetch() error {
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, f.uri, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if u.User != nil && u.User.String() != "" {
+	// credentials embedded in the URL take precedence over the host options for compatibility
+	if u := f.url; u.User != nil && u.User.String() != "" {
 		if passwd, isSet := u.User.Password(); isSet {
 			req.SetBasicAuth(u.User.Username(), passwd)
 		} else {
 			req.SetBasicAuth(u.User.Username(), "")
 		}
+	} else if f.host != nil && f.host.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+f.host.bearerToken)
+	} else if f.host != nil && f.host.username != "" {
+		req.SetBasicAuth(f.host.username, f.host.password)
+	}
+	offset := f.written
+	if offset > 0 && f.validator != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", f.validator)
 	}
 
-	var client *http.Client
-	cacheKey := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
-	if cacheClient, exists := h.pool[cacheKey]; !exists {
-		tlsConfig := &tls.Config{}
-		if u.Scheme == "http" || h.insecureSkipVerify {
-			tlsConfig.InsecureSkipVerify = true
-		} else {
-			tlsConfig.InsecureSkipVerify = false
-			tlsConfig.RootCAs = h.certPool
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if err := f.restart(); err != nil {
+			return err
 		}
-		cacheClient = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-			},
-			Timeout: time.Second * time.Duration(h.timeout),
+		if resp.Header.Get("Accept-Ranges") == "bytes" {
+			if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				f.validator = etag
+			} else {
+				f.validator = resp.Header.Get("Last-Modified")
+			}
 		}
-		h.pool[cacheKey] = cacheClient
-		client = cacheClient
-	} else {
-		client = cacheClient
-	}
-	if client == nil {
-		client = h.defaultClient
+	case resp.StatusCode == http.StatusPartialContent && int64(contentRangeStart(resp.Header.Get("Content-Range"))) == offset:
+	case resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the range is not the requested one, download the whole content again
+		if err := f.restart(); err != nil {
+			return err
+		}
+		return f.fetch()
+	default:
+		return newStatusError(f.uri, resp)
 	}
+	// the partial content is kept for resuming
+	n, err := io.Copy(f.w, resp.Body)
+	f.written += n
+	return err
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// restart discards the content written by the previous attempts, which is only possible for buffers
+// and files.
+func (f *httpFetch) restart() error {
+	n := f.written
+	f.written, f.validator = 0, ""
+	if n == 0 {
+		return nil
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("failed to fetch %s : %s", uri, resp.Status)
+	switch w := f.w.(type) {
+	case *bytes.Buffer:
+		w.Truncate(w.Len() - int(n))
+		return nil
+	case *os.File:
+		offset, err := w.Seek(-n, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		return w.Truncate(offset)
 	}
+	return errors.Errorf("failed to fetch %s : can't restart the download after %d bytes are written", RedactURL(f.uri), n)
+}
 
-	buf := bytes.NewBuffer(nil)
-	_, err = io.Copy(buf, resp.Body)
-	return buf, err
+// contentRangeStart returns the first byte position of the Content-Range header, e.g. `bytes 100-199/200`.
+func contentRangeStart(contentRange string) int {
+	start, _, ok := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.Atoi(start)
+	if err != nil {
+		return -1
+	}
+	return n
 }
 
 func (h *HttpDownloader) Provides(scheme string) bool {
@@ -135,3 +439,100 @@ func (h *HttpDownloader) Provides(scheme string) bool {
 	}
 	return false
 }
+
+// newTransport returns the transport without TLS config, which is cloned for each TLS config.
+func newTransport(proxyOptions *ProxyOptions, options *TransportOptions) (*http.Transport, error) {
+	// the environment is read once when the transport is built, rather than once per process as by
+	// http.ProxyFromEnvironment, and is overridden by the options field by field
+	proxyConfig := httpproxy.FromEnvironment()
+	if proxyOptions != nil {
+		for _, proxy := range []string{proxyOptions.HTTPProxy, proxyOptions.HTTPSProxy} {
+			if _, err := url.Parse(proxy); err != nil {
+				return nil, errors.Errorf("invalid proxy %s", RedactURL(proxy))
+			}
+		}
+		if proxyOptions.HTTPProxy != "" {
+			proxyConfig.HTTPProxy = proxyOptions.HTTPProxy
+		}
+		if proxyOptions.HTTPSProxy != "" {
+			proxyConfig.HTTPSProxy = proxyOptions.HTTPSProxy
+		}
+		if proxyOptions.NoProxy != "" {
+			proxyConfig.NoProxy = proxyOptions.NoProxy
+		}
+	}
+	proxyFunc := proxyConfig.ProxyFunc()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	if options == nil {
+		return transport, nil
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if options.DialTimeout != nil {
+		dialer.Timeout = options.DialTimeout.Duration
+	}
+	if options.KeepAlive != nil {
+		dialer.KeepAlive = options.KeepAlive.Duration
+	}
+	transport.DialContext = dialer.DialContext
+	if options.TLSHandshakeTimeout != nil {
+		transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout.Duration
+	}
+	if options.IdleConnTimeout != nil {
+		transport.IdleConnTimeout = options.IdleConnTimeout.Duration
+	}
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	transport.DisableKeepAlives = options.DisableKeepAlives
+	return transport, nil
+}
+
+// newTLSConfig returns the TLS config trusting the system CAs and the given base64 encoded or file CA bundle.
+func newTLSConfig(caBundle, caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	certPool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	if caBundle != "" {
+		data, err := base64.StdEncoding.DecodeString(caBundle)
+		if err != nil {
+			return nil, errors.Errorf("can't decode CaBundle: %v", err)
+		}
+		certPool.AppendCertsFromPEM(data)
+	}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Errorf("can't read CaFile: %v", err)
+		}
+		if !certPool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in CaFile %s", caFile)
+		}
+	}
+	return &tls.Config{InsecureSkipVerify: insecureSkipVerify, RootCAs: certPool}, nil
+}
+
+// RedactURL returns the URL with its password masked, it should be used whenever a URL is logged or
+// returned in errors.
+func RedactURL(uri string) string {
+	if u, err := url.Parse(uri); err == nil {
+		return u.Redacted()
+	}
+	// mask the userinfo of URLs that can't be parsed
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return uri
+	}
+	authority, path, _ := strings.Cut(rest, "/")
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		authority = "xxxxx" + authority[i:]
+	}
+	if path != "" || strings.HasSuffix(rest, "/") {
+		return scheme + "://" + authority + "/" + path
+	}
+	return scheme + "://" + authority
+}
@@ -0,0 +1,78 @@
+package download
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MirrorRule rewrites the chart URIs matching either the prefix or the regex to its mirrors, e.g.
+// `https://charts.kubesphere.io/` or `oci://hub.kubesphere.com.cn/` to an internal mirror.
+type MirrorRule struct {
+	// Prefix is replaced by the mirrors, e.g. `https://charts.kubesphere.io/main/` -> `https://charts.local/main/`.
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// Regex matches the whole URI, which is replaced by the mirrors with submatches expanded,
+	// e.g. `^oci://hub.kubesphere.com.cn/(.*)$` -> `oci://harbor.local/$1`.
+	Regex string `json:"regex,omitempty" yaml:"regex,omitempty"`
+	// Mirrors are tried in order until a download succeeds.
+	Mirrors []string `json:"mirrors" yaml:"mirrors"`
+	// Fallback tries the original URI once all the mirrors fail.
+	Fallback bool `json:"fallback,omitempty" yaml:"fallback,omitempty"`
+}
+
+type mirrorRule struct {
+	prefix   string
+	regex    *regexp.Regexp
+	mirrors  []string
+	fallback bool
+}
+
+func newMirrorRules(rules []MirrorRule) ([]mirrorRule, error) {
+	var result []mirrorRule
+	for i, rule := range rules {
+		if (rule.Prefix == "") == (rule.Regex == "") {
+			return nil, fmt.Errorf("mirrors[%d]: exactly one of prefix and regex is required", i)
+		}
+		if len(rule.Mirrors) == 0 {
+			return nil, fmt.Errorf("mirrors[%d]: mirrors is required", i)
+		}
+		r := mirrorRule{prefix: rule.Prefix, mirrors: rule.Mirrors, fallback: rule.Fallback}
+		if rule.Regex != "" {
+			regex, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("mirrors[%d]: invalid regex: %v", i, err)
+			}
+			r.regex = regex
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// rewrite returns the URIs to try in order by the first rule matching the URI, which is the URI itself
+// if no rule matches.
+func (c *ChartDownloader) rewrite(uri string) []string {
+	for _, rule := range c.mirrors {
+		var candidates []string
+		switch {
+		case rule.regex != nil:
+			if !rule.regex.MatchString(uri) {
+				continue
+			}
+			for _, mirror := range rule.mirrors {
+				candidates = append(candidates, rule.regex.ReplaceAllString(uri, mirror))
+			}
+		case strings.HasPrefix(uri, rule.prefix):
+			for _, mirror := range rule.mirrors {
+				candidates = append(candidates, mirror+strings.TrimPrefix(uri, rule.prefix))
+			}
+		default:
+			continue
+		}
+		if rule.fallback {
+			candidates = append(candidates, uri)
+		}
+		return candidates
+	}
+	return []string{uri}
+}
@@ -0,0 +1,114 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChartDownloaderRewrite(t *testing.T) {
+	chartDownloader, err := NewChartDownloader(&Options{Mirrors: []MirrorRule{
+		{Prefix: "https://charts.kubesphere.io/", Mirrors: []string{"https://charts.local/", "https://backup.local/"}, Fallback: true},
+		{Regex: `^oci://hub\.kubesphere\.com\.cn/(.*)$`, Mirrors: []string{"oci://harbor.local/mirror/$1"}},
+		{Prefix: "https://", Mirrors: []string{"https://proxy.local/"}},
+	}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"https://charts.local/main/devops-1.2.0.tgz",
+		"https://backup.local/main/devops-1.2.0.tgz",
+		"https://charts.kubesphere.io/main/devops-1.2.0.tgz",
+	}, chartDownloader.rewrite("https://charts.kubesphere.io/main/devops-1.2.0.tgz"))
+	assert.Equal(t, []string{"oci://harbor.local/mirror/kse-extensions/devops:1.2.0"},
+		chartDownloader.rewrite("oci://hub.kubesphere.com.cn/kse-extensions/devops:1.2.0"))
+	// the first matching rule applies
+	assert.Equal(t, []string{"https://proxy.local/github.com/devops-1.2.0.tgz"},
+		chartDownloader.rewrite("https://github.com/devops-1.2.0.tgz"))
+	assert.Equal(t, []string{"/tmp/devops-1.2.0.tgz"}, chartDownloader.rewrite("/tmp/devops-1.2.0.tgz"))
+}
+
+func TestChartDownloaderMirrors(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path != "/backup/devops-1.2.0.tgz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("devops"))
+	}))
+	defer server.Close()
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "", "")
+	reg.pushChart(t, "mirror/kse-extensions/devops", "1.2.0", archive)
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		HttpOptions: &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+		OCIOptions:  &OCIDownloaderOptions{PlainHTTP: true},
+		Cache:       &CacheOptions{Disabled: true},
+		Mirrors: []MirrorRule{
+			{Prefix: "https://charts.kubesphere.io/", Mirrors: []string{server.URL + "/primary/", server.URL + "/backup/"}},
+			{Prefix: "https://missing.kubesphere.io/", Mirrors: []string{server.URL + "/primary/"}, Fallback: true},
+			{Regex: `^oci://hub\.kubesphere\.com\.cn/(.*)$`, Mirrors: []string{"oci://" + reg.host() + "/mirror/$1"}},
+		},
+	})
+	require.NoError(t, err)
+
+	buf, err := chartDownloader.Download(context.Background(), "https://charts.kubesphere.io/devops-1.2.0.tgz")
+	require.NoError(t, err)
+	assert.Equal(t, "devops", buf.String())
+	assert.Equal(t, []string{"/primary/devops-1.2.0.tgz", "/backup/devops-1.2.0.tgz"}, paths)
+
+	buf, err = chartDownloader.Download(context.Background(), "oci://hub.kubesphere.com.cn/kse-extensions/devops:1.2.0")
+	require.NoError(t, err)
+	assert.Equal(t, archive, buf.Bytes())
+
+	_, err = chartDownloader.Download(context.Background(), "https://missing.kubesphere.io/devops-1.2.0.tgz")
+	assert.ErrorContains(t, err, "failed to download https://missing.kubesphere.io/devops-1.2.0.tgz from all mirrors")
+}
+
+func TestChartDownloaderMirrorsCosign(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		_, _ = w.Write([]byte("devops"))
+	}))
+	defer server.Close()
+	options := &Options{
+		HttpOptions: &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+		Mirrors:     []MirrorRule{{Prefix: "oci://hub.kubesphere.com.cn/", Mirrors: []string{server.URL + "/"}}},
+	}
+
+	// the https mirror serves the chart without cosign, which also fills the cache of the oci:// chart
+	unverified, err := NewChartDownloader(options)
+	require.NoError(t, err)
+	buf, err := unverified.Download(context.Background(), "oci://hub.kubesphere.com.cn/kse-extensions/devops:1.2.0")
+	require.NoError(t, err)
+	assert.Equal(t, "devops", buf.String())
+	assert.Equal(t, []string{"/kse-extensions/devops:1.2.0"}, paths)
+
+	// the https mirror can't verify the cosign signature required by the oci:// chart, nor is the cache used
+	options.OCIOptions = &OCIDownloaderOptions{Cosign: &CosignOptions{PublicKey: testPublicKeyPEM(t, newTestSigner(t).key)}}
+	chartDownloader, err := NewChartDownloader(options, WithChartCache(unverified.Cache()))
+	require.NoError(t, err)
+	_, err = chartDownloader.Download(context.Background(), "oci://hub.kubesphere.com.cn/kse-extensions/devops:1.2.0")
+	assert.ErrorContains(t, err, "can't verify the required cosign signature")
+	assert.ErrorAs(t, err, new(*VerificationError))
+	assert.Len(t, paths, 1)
+}
+
+func TestMirrorRulesErrors(t *testing.T) {
+	for _, rules := range [][]MirrorRule{
+		{{Mirrors: []string{"https://charts.local/"}}},
+		{{Prefix: "https://charts.kubesphere.io/", Regex: "^https://", Mirrors: []string{"https://charts.local/"}}},
+		{{Prefix: "https://charts.kubesphere.io/"}},
+		{{Regex: "(", Mirrors: []string{"https://charts.local/"}}},
+	} {
+		_, err := NewChartDownloader(&Options{Mirrors: rules})
+		assert.Error(t, err)
+	}
+}
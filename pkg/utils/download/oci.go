@@ -1,34 +1,211 @@
 package download
 
 import (
-	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
+	"sync"
 
+	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/registry"
 )
 
-type OCIDownloaderOptions struct{}
+// DockerConfigJSONKey is the key of the docker config in a kubernetes.io/dockerconfigjson Secret.
+const DockerConfigJSONKey = ".dockerconfigjson"
+
+type OCIDownloaderOptions struct {
+	// Username and Password are used for the registries without specific credentials.
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	// DockerConfigJSON is the content of a docker config file containing the credentials of registries.
+	DockerConfigJSON string `json:"dockerConfigJson,omitempty" yaml:"dockerConfigJson,omitempty"`
+	// DockerConfigSecret refers to a kubernetes.io/dockerconfigjson Secret containing the credentials of registries,
+	// which is read on the first pull.
+	DockerConfigSecret *SecretReference `json:"dockerConfigSecret,omitempty" yaml:"dockerConfigSecret,omitempty"`
+	// CaBundle is a base64 encoded PEM bundle, CaFile is the path of a PEM bundle.
+	CaBundle           string `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	CaFile             string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+	PlainHTTP          bool   `json:"plainHTTP,omitempty" yaml:"plainHTTP,omitempty"`
+	// Registries contains the options of specific registries by host, e.g. `harbor.local:8443`,
+	// which override the options above.
+	Registries map[string]RegistryOptions `json:"registries,omitempty" yaml:"registries,omitempty"`
+	// Retry configures the retries of the requests to registries.
+	Retry *RetryOptions `json:"retry,omitempty" yaml:"retry,omitempty"`
+	// Cosign requires the charts to be signed by cosign, the signatures are verified after the charts are pulled.
+	Cosign *CosignOptions `json:"cosign,omitempty" yaml:"cosign,omitempty"`
+	// Proxy and Transport default to the ones of HttpDownloaderOptions for the ChartDownloader.
+	Proxy     *ProxyOptions     `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	Transport *TransportOptions `json:"transport,omitempty" yaml:"transport,omitempty"`
+}
+
+type RegistryOptions struct {
+	Username           string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password           string `json:"password,omitempty" yaml:"password,omitempty"`
+	CaBundle           string `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	CaFile             string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+	InsecureSkipVerify *bool  `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+	PlainHTTP          *bool  `json:"plainHTTP,omitempty" yaml:"plainHTTP,omitempty"`
+}
+
+// SecretReference refers to a key of a Secret, which is read by the SecretGetter of the ChartDownloader.
+type SecretReference struct {
+	Namespace string `json:"namespace" yaml:"namespace"`
+	Name      string `json:"name" yaml:"name"`
+	// Key defaults to the key of the specific Secret type, e.g. DockerConfigJSONKey.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// SecretGetter returns the data of the Secret.
+type SecretGetter func(ctx context.Context, namespace, name string) (map[string][]byte, error)
 
 var ociDefaultSchemes = []string{"oci"}
 
+// OCIDownloader is safe for concurrent use, the transports of registries are created on first use.
 type OCIDownloader struct {
-	client  *registry.Client
-	Schemes []string
+	options     OCIDownloaderOptions
+	credentials map[string]credential
+	retrier     *retrier
+	cosign      *CosignVerifier
+
+	secretGetter       SecretGetter
+	secretMu           sync.Mutex
+	dockerConfigSecret map[string]credential
+
+	// baseTransport is cloned for the transports of registries
+	baseTransport *http.Transport
+	mu            sync.Mutex
+	transports    map[string]*http.Transport
+	Schemes       []string
+}
+
+type credential struct {
+	username string
+	password string
 }
 
-func NewOCIDownloader(_ *OCIDownloaderOptions) (*OCIDownloader, error) {
-	client, err := registry.NewClient()
+func NewOCIDownloader(options *OCIDownloaderOptions, secretGetter SecretGetter) (*OCIDownloader, error) {
+	o := &OCIDownloader{
+		credentials: make(map[string]credential),
+		transports:  make(map[string]*http.Transport),
+		Schemes:     ociDefaultSchemes,
+	}
+	if options == nil {
+		options = &OCIDownloaderOptions{}
+	}
+	o.options = *options
+	o.retrier = newRetrier(options.Retry)
+	transport, err := newTransport(options.Proxy, options.Transport)
 	if err != nil {
 		return nil, err
 	}
-	return &OCIDownloader{
-		client:  client,
-		Schemes: ociDefaultSchemes,
-	}, nil
+	o.baseTransport = transport
+	if options.Cosign != nil {
+		verifier, err := NewCosignVerifier(options.Cosign)
+		if err != nil {
+			return nil, errors.Errorf("invalid cosign options: %v", err)
+		}
+		o.cosign = verifier
+	}
+
+	if options.DockerConfigSecret != nil && secretGetter == nil {
+		return nil, errors.New("dockerConfigSecret requires access to secrets")
+	}
+	o.secretGetter = secretGetter
+	// inline docker config takes precedence over the secret
+	if options.DockerConfigJSON != "" {
+		credentials, err := parseDockerConfig([]byte(options.DockerConfigJSON))
+		if err != nil {
+			return nil, errors.Errorf("invalid dockerConfigJson: %v", err)
+		}
+		o.credentials = credentials
+	}
+	for host, registryOptions := range options.Registries {
+		if registryOptions.Username != "" {
+			o.credentials[host] = credential{username: registryOptions.Username, password: registryOptions.Password}
+		}
+	}
+	return o, nil
+}
+
+// dockerConfig is the format of .dockerconfigjson.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"`
+		Auth     string `json:"auth,omitempty"`
+	} `json:"auths"`
+}
+
+// parseDockerConfig returns the credentials of the docker config by registry host.
+func parseDockerConfig(data []byte) (map[string]credential, error) {
+	config := &dockerConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]credential, len(config.Auths))
+	for server, auth := range config.Auths {
+		username, password := auth.Username, auth.Password
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.Errorf("invalid auth of %s: %v", server, err)
+			}
+			var ok bool
+			username, password, ok = strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, errors.Errorf("invalid auth of %s: expected username:password", server)
+			}
+		}
+		credentials[registryHost(server)] = credential{username: username, password: password}
+	}
+	return credentials, nil
+}
+
+// secretCredentials returns the credentials of the DockerConfigSecret, which is read on the first pull
+// instead of the construction, so that a missing Secret only fails the pulls. Failed reads are retried
+// by the next pull.
+func (o *OCIDownloader) secretCredentials(ctx context.Context) (map[string]credential, error) {
+	ref := o.options.DockerConfigSecret
+	if ref == nil {
+		return nil, nil
+	}
+	o.secretMu.Lock()
+	defer o.secretMu.Unlock()
+	if o.dockerConfigSecret != nil {
+		return o.dockerConfigSecret, nil
+	}
+	key := ref.Key
+	if key == "" {
+		key = DockerConfigJSONKey
+	}
+	data, err := o.secretGetter(ctx, ref.Namespace, ref.Name)
+	if err != nil {
+		return nil, errors.Errorf("failed to get secret %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	if _, ok := data[key]; !ok {
+		return nil, errors.Errorf("key %s not found in secret %s/%s", key, ref.Namespace, ref.Name)
+	}
+	credentials, err := parseDockerConfig(data[key])
+	if err != nil {
+		return nil, errors.Errorf("invalid docker config in secret %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	o.dockerConfigSecret = credentials
+	return credentials, nil
+}
+
+// registryHost returns the host of the docker config server, e.g. `https://harbor.local/v1/` -> `harbor.local`.
+func registryHost(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host, _, _ := strings.Cut(server, "/")
+	return host
 }
 
-func (o *OCIDownloader) Get(uri string) (*bytes.Buffer, error) {
+func (o *OCIDownloader) Get(ctx context.Context, uri string, w io.Writer) error {
 	ref := strings.TrimPrefix(uri, fmt.Sprintf("%s://", registry.OCIScheme))
 
 	var pullOpts []registry.PullOption
@@ -40,15 +217,122 @@ func (o *OCIDownloader) Get(uri string) (*bytes.Buffer, error) {
 			registry.PullOptWithProv(true))
 	}
 
-	result, err := o.client.Pull(ref, pullOpts...)
+	host := registryHost(ref)
+	client, err := o.client(ctx, host)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	result, err := client.Pull(ref, pullOpts...)
+	if err != nil {
+		return err
+	}
+	// the registry client pulls `repo:tag@digest` by the tag, the pinned digest is verified here
+	if _, digest, ok := strings.Cut(ref, "@"); ok && result.Manifest.Digest != digest {
+		return &VerificationError{Err: errors.Errorf("manifest of %s doesn't match the pinned digest, got %s", uri, result.Manifest.Digest)}
+	}
+	if o.cosign != nil && !requestingProv {
+		if err := o.verifyCosignSignature(ctx, host, ref, result.Manifest.Digest); err != nil {
+			return &VerificationError{Err: errors.Errorf("failed to verify cosign signature of %s: %v", uri, err)}
+		}
 	}
 
 	if requestingProv {
-		return bytes.NewBuffer(result.Prov.Data), nil
+		_, err = w.Write(result.Prov.Data)
+	} else {
+		_, err = w.Write(result.Chart.Data)
+	}
+	return err
+}
+
+// client returns a registry client of the host whose requests are bound to the context, since the
+// registry client doesn't accept a context. The transports are cached to reuse connections.
+func (o *OCIDownloader) client(ctx context.Context, host string) (*registry.Client, error) {
+	transport, err := o.transport(host)
+	if err != nil {
+		return nil, err
+	}
+
+	clientOpts := []registry.ClientOption{
+		registry.ClientOptHTTPClient(&http.Client{
+			Transport: &contextTransport{ctx: ctx, base: &retryTransport{base: transport, retrier: o.retrier}},
+		}),
+	}
+	cred, ok, err := o.credential(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		clientOpts = append(clientOpts, registry.ClientOptBasicAuth(cred.username, cred.password))
+	}
+	if o.plainHTTP(host) {
+		clientOpts = append(clientOpts, registry.ClientOptPlainHTTP())
+	}
+	return registry.NewClient(clientOpts...)
+}
+
+// credential returns the credential of the host, which defaults to the DockerConfigSecret and then
+// Username and Password.
+func (o *OCIDownloader) credential(ctx context.Context, host string) (credential, bool, error) {
+	if cred, ok := o.credentials[host]; ok {
+		return cred, true, nil
+	}
+	secretCredentials, err := o.secretCredentials(ctx)
+	if err != nil {
+		return credential{}, false, err
+	}
+	if cred, ok := secretCredentials[host]; ok {
+		return cred, true, nil
+	}
+	if o.options.Username != "" {
+		return credential{username: o.options.Username, password: o.options.Password}, true, nil
+	}
+	return credential{}, false, nil
+}
+
+func (o *OCIDownloader) plainHTTP(host string) bool {
+	if plainHTTP := o.options.Registries[host].PlainHTTP; plainHTTP != nil {
+		return *plainHTTP
+	}
+	return o.options.PlainHTTP
+}
+
+// transport returns the transport of the host, which is created on first use.
+func (o *OCIDownloader) transport(host string) (*http.Transport, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if transport, ok := o.transports[host]; ok {
+		return transport, nil
+	}
+
+	registryOptions := o.options.Registries[host]
+	insecureSkipVerify := o.options.InsecureSkipVerify
+	if registryOptions.InsecureSkipVerify != nil {
+		insecureSkipVerify = *registryOptions.InsecureSkipVerify
+	}
+	caBundle, caFile := o.options.CaBundle, o.options.CaFile
+	if registryOptions.CaBundle != "" || registryOptions.CaFile != "" {
+		caBundle, caFile = registryOptions.CaBundle, registryOptions.CaFile
+	}
+	transport := o.baseTransport.Clone()
+	if insecureSkipVerify || caBundle != "" || caFile != "" {
+		tlsConfig, err := newTLSConfig(caBundle, caFile, insecureSkipVerify)
+		if err != nil {
+			return nil, errors.Errorf("invalid TLS options of registry %s: %v", host, err)
+		}
+		transport.TLSClientConfig = tlsConfig
 	}
-	return bytes.NewBuffer(result.Chart.Data), nil
+	o.transports[host] = transport
+	return transport, nil
+}
+
+// contextTransport binds the requests to the context.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
 }
 
 func (o *OCIDownloader) Provides(scheme string) bool {
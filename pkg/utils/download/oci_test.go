@@ -1,15 +1,421 @@
 package download
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/registry"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestOCIDownloaderGet(t *testing.T) {
-	uri := "oci://hub.kubesphere.com.cn/kse-extensions/whizard-monitoring:1.0.0-rc.4"
-	d, err := NewOCIDownloader(&OCIDownloaderOptions{})
-	assert.Equal(t, err, nil)
-	_, err = d.Get(uri)
-	assert.Equal(t, err, nil)
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "", "")
+	digest := reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+
+	tests := []struct {
+		name     string
+		uri      string
+		failures int
+		wantErr  string
+	}{
+		{
+			name: "tag",
+			uri:  "oci://" + reg.host() + "/extensions/devops:1.2.0",
+		},
+		{
+			name: "tag and digest",
+			uri:  "oci://" + reg.host() + "/extensions/devops:1.2.0@" + digest,
+		},
+		{
+			name:    "tag not found",
+			uri:     "oci://" + reg.host() + "/extensions/devops:1.3.0",
+			wantErr: "not found",
+		},
+		{
+			name:    "repository not found",
+			uri:     "oci://" + reg.host() + "/extensions/missing:1.2.0",
+			wantErr: "not found",
+		},
+		{
+			name:     "unavailable",
+			uri:      "oci://" + reg.host() + "/extensions/devops:1.2.0",
+			failures: 1,
+			wantErr:  "503 Service Unavailable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg.mu.Lock()
+			reg.failures = tt.failures
+			reg.mu.Unlock()
+			d, err := NewOCIDownloader(&OCIDownloaderOptions{PlainHTTP: true, Retry: &RetryOptions{MaxAttempts: 1}}, nil)
+			require.NoError(t, err)
+			buf := bytes.NewBuffer(nil)
+			err = d.Get(context.Background(), tt.uri, buf)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, archive, buf.Bytes())
+		})
+	}
+}
+
+func TestOCIDownloaderAuth(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "admin", "secret")
+	reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+	uri := "oci://" + reg.host() + "/extensions/devops:1.2.0"
+
+	tests := []struct {
+		name    string
+		options *OCIDownloaderOptions
+		secrets map[string]map[string][]byte
+		wantErr bool
+	}{
+		{
+			name:    "anonymous",
+			options: &OCIDownloaderOptions{PlainHTTP: true},
+			wantErr: true,
+		},
+		{
+			name:    "username and password",
+			options: &OCIDownloaderOptions{PlainHTTP: true, Username: "admin", Password: "secret"},
+		},
+		{
+			name: "registry credentials",
+			options: &OCIDownloaderOptions{
+				Username: "other", Password: "other",
+				Registries: map[string]RegistryOptions{
+					reg.host(): {Username: "admin", Password: "secret", PlainHTTP: ptr(true)},
+				},
+			},
+		},
+		{
+			name: "docker config",
+			options: &OCIDownloaderOptions{
+				PlainHTTP:        true,
+				DockerConfigJSON: testDockerConfig(reg.host(), "admin", "secret"),
+			},
+		},
+		{
+			name: "docker config secret",
+			options: &OCIDownloaderOptions{
+				PlainHTTP:          true,
+				DockerConfigSecret: &SecretReference{Namespace: "kubesphere-system", Name: "registry"},
+			},
+			secrets: map[string]map[string][]byte{
+				"kubesphere-system/registry": {DockerConfigJSONKey: []byte(testDockerConfig(reg.host(), "admin", "secret"))},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getter := func(_ context.Context, namespace, name string) (map[string][]byte, error) {
+				data, ok := tt.secrets[namespace+"/"+name]
+				if !ok {
+					return nil, fmt.Errorf("secret %s/%s not found", namespace, name)
+				}
+				return data, nil
+			}
+			d, err := NewOCIDownloader(tt.options, getter)
+			require.NoError(t, err)
+			buf := bytes.NewBuffer(nil)
+			err = d.Get(context.Background(), uri, buf)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, archive, buf.Bytes())
+		})
+	}
+}
+
+func TestOCIDownloaderSecretOnFirstPull(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "admin", "secret")
+	reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+	uri := "oci://" + reg.host() + "/extensions/devops:1.2.0"
+
+	type ctxKey struct{}
+	var secret map[string][]byte
+	getter := func(ctx context.Context, namespace, name string) (map[string][]byte, error) {
+		if ctx.Value(ctxKey{}) == nil {
+			return nil, fmt.Errorf("secret is read without the context of the pull")
+		}
+		if secret == nil {
+			return nil, fmt.Errorf("secret %s/%s not found", namespace, name)
+		}
+		return secret, nil
+	}
+	d, err := NewOCIDownloader(&OCIDownloaderOptions{
+		PlainHTTP:          true,
+		DockerConfigSecret: &SecretReference{Namespace: "kubesphere-system", Name: "registry"},
+		Retry:              &RetryOptions{MaxAttempts: 1},
+	}, getter)
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	err = d.Get(ctx, uri, io.Discard)
+	assert.ErrorContains(t, err, "failed to get secret kubesphere-system/registry")
+
+	// the secret is read again once it is created
+	secret = map[string][]byte{DockerConfigJSONKey: []byte(testDockerConfig(reg.host(), "admin", "secret"))}
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, d.Get(ctx, uri, buf))
+	assert.Equal(t, archive, buf.Bytes())
+}
+
+func TestOCIDownloaderRetry(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "", "")
+	reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+	uri := "oci://" + reg.host() + "/extensions/devops:1.2.0"
+	backoff := &metav1.Duration{Duration: time.Millisecond}
+
+	reg.failures = 2
+	d, err := NewOCIDownloader(&OCIDownloaderOptions{
+		PlainHTTP: true,
+		Retry:     &RetryOptions{InitialBackoff: backoff},
+	}, nil)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	err = d.Get(context.Background(), uri, buf)
+	require.NoError(t, err)
+	assert.Equal(t, archive, buf.Bytes())
+
+	reg.failures = 1
+	d, err = NewOCIDownloader(&OCIDownloaderOptions{
+		PlainHTTP: true,
+		Retry:     &RetryOptions{MaxAttempts: 1},
+	}, nil)
+	require.NoError(t, err)
+	err = d.Get(context.Background(), uri, io.Discard)
+	assert.Error(t, err)
+}
+
+func TestOCIDownloaderOptionsErrors(t *testing.T) {
+	_, err := NewOCIDownloader(&OCIDownloaderOptions{DockerConfigSecret: &SecretReference{Name: "registry"}}, nil)
+	assert.Error(t, err)
+	_, err = NewOCIDownloader(&OCIDownloaderOptions{DockerConfigJSON: `{"auths": {"harbor.local": {"auth": "invalid"}}}`}, nil)
+	assert.Error(t, err)
+
+	// the TLS options are applied when the client of the registry is created
+	d, err := NewOCIDownloader(&OCIDownloaderOptions{
+		Registries: map[string]RegistryOptions{"harbor.local": {CaFile: filepath.Join(t.TempDir(), "missing.crt")}},
+	}, nil)
+	require.NoError(t, err)
+	err = d.Get(context.Background(), "oci://harbor.local/extensions/devops:1.2.0", io.Discard)
+	assert.ErrorContains(t, err, "invalid TLS options of registry harbor.local")
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "harbor.local", registryHost("https://harbor.local/v1/"))
+	assert.Equal(t, "harbor.local:8443", registryHost("harbor.local:8443/library/devops:1.2.0"))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func testDockerConfig(host, username, password string) string {
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return fmt.Sprintf(`{"auths": {"https://%s": {"auth": %q}}}`, host, auth)
+}
+
+// testChartArchive returns the archive of a minimal chart.
+func testChartArchive(t *testing.T, name, version string) []byte {
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: version},
+		Raw:      []*chart.File{{Name: chartutil.ValuesfileName, Data: []byte("replicas: 1\n")}},
+	}
+	path, err := chartutil.Save(ch, t.TempDir())
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
+
+// testRegistry is a minimal in-process OCI distribution registry serving pushed manifests and blobs.
+type testRegistry struct {
+	*httptest.Server
+	username string
+	password string
+
+	mu sync.Mutex
+	// failures is the number of the following requests failing with 503
+	failures  int
+	blobs     map[string][]byte
+	manifests map[string][]byte
+}
+
+func newTestRegistry(t *testing.T, tls bool, username, password string) *testRegistry {
+	r := &testRegistry{
+		username:  username,
+		password:  password,
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+	}
+	if tls {
+		r.Server = httptest.NewTLSServer(r)
+	} else {
+		r.Server = httptest.NewServer(r)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.URL, "http://"), "https://")
+}
+
+func (r *testRegistry) addBlob(data []byte) string {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[digest] = data
+	return digest
+}
+
+// pushManifest stores the manifest by tag and digest, it returns the digest of the manifest.
+func (r *testRegistry) pushManifest(repo, tag string, manifest []byte) string {
+	digest := r.addBlob(manifest)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[repo+"@"+digest] = manifest
+	if tag != "" {
+		r.manifests[repo+":"+tag] = manifest
+	}
+	return digest
+}
+
+type testDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int               `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// pushChart pushes the chart archive the same way as `helm push`, it returns the digest of the manifest.
+func (r *testRegistry) pushChart(t *testing.T, repo, tag string, archive []byte, extraLayers ...testDescriptor) string {
+	config, err := json.Marshal(&chart.Metadata{APIVersion: chart.APIVersionV2, Name: filepath.Base(repo), Version: tag})
+	require.NoError(t, err)
+
+	layers := []testDescriptor{{MediaType: registry.ChartLayerMediaType, Digest: r.addBlob(archive), Size: len(archive)}}
+	layers = append(layers, extraLayers...)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        testDescriptor{MediaType: registry.ConfigMediaType, Digest: r.addBlob(config), Size: len(config)},
+		"layers":        layers,
+	})
+	require.NoError(t, err)
+	return r.pushManifest(repo, tag, manifest)
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	failing := r.failures > 0
+	if failing {
+		r.failures--
+	}
+	r.mu.Unlock()
+	if failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.username != "" {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var data []byte
+	var ok bool
+	contentType := "application/octet-stream"
+	r.mu.Lock()
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		repo, ref := path[:i], path[i+len("/manifests/"):]
+		sep := ":"
+		if strings.HasPrefix(ref, "sha256:") {
+			sep = "@"
+		}
+		data, ok = r.manifests[repo+sep+ref]
+		contentType = "application/vnd.oci.image.manifest.v1+json"
+	} else if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		data, ok = r.blobs[path[i+len("/blobs/"):]]
+	}
+	r.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(data)))
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+func TestOCIDownloaderCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	d, err := NewOCIDownloader(&OCIDownloaderOptions{PlainHTTP: true}, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = d.Get(ctx, "oci://"+host+"/extensions/devops:1.2.0", io.Discard)
+	assert.ErrorContains(t, err, context.DeadlineExceeded.Error())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestOCIDownloaderPinnedDigest(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	reg := newTestRegistry(t, false, "", "")
+	digest := reg.pushChart(t, "extensions/devops", "1.2.0", archive)
+	other := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+
+	d, err := NewOCIDownloader(&OCIDownloaderOptions{PlainHTTP: true}, nil)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	err = d.Get(context.Background(), "oci://"+reg.host()+"/extensions/devops:1.2.0@"+digest, buf)
+	require.NoError(t, err)
+	assert.Equal(t, archive, buf.Bytes())
+
+	err = d.Get(context.Background(), "oci://"+reg.host()+"/extensions/devops:1.2.0@"+other, io.Discard)
+	assert.Error(t, err)
 }
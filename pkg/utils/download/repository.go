@@ -0,0 +1,88 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/repo"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// indexTTL is how long the index of a Helm repository is cached.
+const indexTTL = 5 * time.Minute
+
+type repositoryIndex struct {
+	index   *repo.IndexFile
+	fetched time.Time
+}
+
+// ResolveChart returns the URI and the digest of the chart in the global registry. The version of the charts
+// in a Helm repository can be a constraint, which is resolved to the latest matching version by the index
+// of the repository. The URI is built by convention if the repository has no index and the version is exact.
+func (c *ChartDownloader) ResolveChart(ctx context.Context, chartName, chartVersion string) (string, string, error) {
+	registryUrl := strings.TrimRight(c.globalRegistryUrl.String(), "/")
+	if c.globalRegistryUrl.Scheme == "oci" {
+		return fmt.Sprintf("%s/%s:%s", registryUrl, chartName, chartVersion), "", nil
+	}
+
+	index, err := c.repositoryIndex(ctx, registryUrl)
+	if err != nil {
+		if _, versionErr := semver.StrictNewVersion(chartVersion); versionErr != nil {
+			return "", "", err
+		}
+		klog.Warningf("failed to get index of repository %s, downloading %s-%s by convention: %v", RedactURL(registryUrl), chartName, chartVersion, err)
+		return fmt.Sprintf("%s/%s-%s.tgz", registryUrl, chartName, chartVersion), "", nil
+	}
+	entry, err := index.Get(chartName, chartVersion)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve chart %s %s in repository %s: %v", chartName, chartVersion, RedactURL(registryUrl), err)
+	}
+	if len(entry.URLs) == 0 {
+		return "", "", fmt.Errorf("chart %s %s in repository %s has no URL", chartName, entry.Version, RedactURL(registryUrl))
+	}
+	chartUri, err := repo.ResolveReferenceURL(registryUrl, entry.URLs[0])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid URL of chart %s %s in repository %s: %v", chartName, entry.Version, RedactURL(registryUrl), err)
+	}
+	return chartUri, entry.Digest, nil
+}
+
+// repositoryIndex returns the index of the Helm repository, which is cached for indexTTL.
+func (c *ChartDownloader) repositoryIndex(ctx context.Context, registryUrl string) (*repo.IndexFile, error) {
+	c.mu.Lock()
+	cached, ok := c.indexes[registryUrl]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetched) < indexTTL {
+		return cached.index, nil
+	}
+
+	indexUri := registryUrl + "/index.yaml"
+	buf, err := c.fromMirrors(ctx, indexUri, c.rewrite(indexUri), func(candidate string, buf *bytes.Buffer) error {
+		downloader, err := c.downloaderOf(candidate)
+		if err != nil {
+			return err
+		}
+		return downloader.Get(ctx, candidate, buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	index := &repo.IndexFile{}
+	if err := yaml.Unmarshal(buf.Bytes(), index); err != nil {
+		return nil, fmt.Errorf("invalid index of repository %s: %v", RedactURL(registryUrl), err)
+	}
+	if index.APIVersion == "" {
+		return nil, fmt.Errorf("invalid index of repository %s: no API version", RedactURL(registryUrl))
+	}
+	index.SortEntries()
+
+	c.mu.Lock()
+	c.indexes[registryUrl] = &repositoryIndex{index: index, fetched: time.Now()}
+	c.mu.Unlock()
+	return index, nil
+}
@@ -0,0 +1,108 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChartDownloaderResolveChart(t *testing.T) {
+	archives := map[string][]byte{
+		"/charts/devops-1.2.0.tgz":   []byte("devops-1.2.0"),
+		"/external/devops-1.2.3.tgz": []byte("devops-1.2.3"),
+		"/charts/devops-1.3.0.tgz":   []byte("devops-1.3.0"),
+	}
+	var indexRequests atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repo/index.yaml" {
+			indexRequests.Add(1)
+			_, _ = fmt.Fprintf(w, `apiVersion: v1
+entries:
+  devops:
+  - name: devops
+    version: 1.2.0
+    urls: [../charts/devops-1.2.0.tgz]
+    digest: %x
+  - name: devops
+    version: 1.3.0
+    urls: [../charts/devops-1.3.0.tgz]
+    digest: %x
+  - name: devops
+    version: 1.2.3
+    urls: [%s/external/devops-1.2.3.tgz]
+    digest: %x
+`, sha256.Sum256(archives["/charts/devops-1.2.0.tgz"]), sha256.Sum256([]byte("tampered")),
+				server.URL, sha256.Sum256(archives["/external/devops-1.2.3.tgz"]))
+			return
+		}
+		data, ok := archives[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		GlobalRegistryUrl: server.URL + "/repo/",
+		HttpOptions:       &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+	})
+	require.NoError(t, err)
+
+	uri, digest, err := chartDownloader.ResolveChart(context.Background(), "devops", "1.2.0")
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/charts/devops-1.2.0.tgz", uri)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(archives["/charts/devops-1.2.0.tgz"])), digest)
+
+	buf, err := chartDownloader.DownloadByNameVersion(context.Background(), "devops", "~1.2")
+	require.NoError(t, err)
+	assert.Equal(t, "devops-1.2.3", buf.String())
+	// the digest in the index is verified
+	_, err = chartDownloader.DownloadByNameVersion(context.Background(), "devops", "1.3.0")
+	assert.ErrorContains(t, err, "doesn't match the digest")
+	_, err = chartDownloader.DownloadByNameVersion(context.Background(), "devops", "2.x")
+	assert.ErrorContains(t, err, "failed to resolve chart devops 2.x")
+	_, err = chartDownloader.DownloadByNameVersion(context.Background(), "other", "1.0.0")
+	assert.ErrorContains(t, err, "failed to resolve chart other 1.0.0")
+	// the index is cached
+	assert.EqualValues(t, 1, indexRequests.Load())
+}
+
+func TestChartDownloaderResolveChartWithoutIndex(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/charts/devops-1.2.0.tgz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("devops-1.2.0"))
+	}))
+	defer server.Close()
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		GlobalRegistryUrl: server.URL + "/charts",
+		HttpOptions:       &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+	})
+	require.NoError(t, err)
+	buf, err := chartDownloader.DownloadByNameVersion(context.Background(), "devops", "1.2.0")
+	require.NoError(t, err)
+	assert.Equal(t, "devops-1.2.0", buf.String())
+	// constraints require the index
+	_, err = chartDownloader.DownloadByNameVersion(context.Background(), "devops", "~1.2")
+	assert.Error(t, err)
+
+	chartDownloader, err = NewChartDownloader(&Options{GlobalRegistryUrl: "oci://harbor.local/extensions"})
+	require.NoError(t, err)
+	uri, digest, err := chartDownloader.ResolveChart(context.Background(), "devops", "1.2.0")
+	require.NoError(t, err)
+	assert.Equal(t, "oci://harbor.local/extensions/devops:1.2.0", uri)
+	assert.Empty(t, digest)
+}
@@ -0,0 +1,218 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// RetryOptions configures the retries of transient failures, i.e. network errors, 5xx and 429 responses.
+type RetryOptions struct {
+	// MaxAttempts defaults to 3, 1 disables retries.
+	MaxAttempts int `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	// InitialBackoff defaults to 1s, it doubles after each attempt up to MaxBackoff, which defaults to 30s
+	// and also limits the delay requested by Retry-After.
+	InitialBackoff *metav1.Duration `json:"initialBackoff,omitempty" yaml:"initialBackoff,omitempty"`
+	MaxBackoff     *metav1.Duration `json:"maxBackoff,omitempty" yaml:"maxBackoff,omitempty"`
+}
+
+type retrier struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	sleep          func(ctx context.Context, d time.Duration) error
+}
+
+func newRetrier(options *RetryOptions) *retrier {
+	r := &retrier{
+		maxAttempts:    defaultMaxAttempts,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		sleep:          sleep,
+	}
+	if options == nil {
+		return r
+	}
+	if options.MaxAttempts > 0 {
+		r.maxAttempts = options.MaxAttempts
+	}
+	if options.InitialBackoff != nil && options.InitialBackoff.Duration > 0 {
+		r.initialBackoff = options.InitialBackoff.Duration
+	}
+	if options.MaxBackoff != nil && options.MaxBackoff.Duration > 0 {
+		r.maxBackoff = options.MaxBackoff.Duration
+	}
+	return r
+}
+
+// do calls fn until it succeeds, fails with a permanent error or the attempts are exhausted.
+func (r *retrier) do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		retryable, retryAfter := classify(err)
+		if !retryable || attempt >= r.maxAttempts {
+			return err
+		}
+		delay := r.backoff(attempt)
+		if retryAfter > 0 {
+			delay = min(retryAfter, r.maxBackoff)
+		}
+		klog.Warningf("attempt %d/%d failed, retrying in %s: %v", attempt, r.maxAttempts, delay, err)
+		if err := r.sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// backoff returns the exponential backoff of the attempt with equal jitter, i.e. a random delay between
+// the half and the whole backoff.
+func (r *retrier) backoff(attempt int) time.Duration {
+	backoff := r.maxBackoff
+	if attempt < 32 && r.initialBackoff<<(attempt-1) < r.maxBackoff {
+		backoff = r.initialBackoff << (attempt - 1)
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// statusError is returned for unexpected HTTP responses.
+type statusError struct {
+	uri        string
+	status     string
+	statusCode int
+	retryAfter time.Duration
+}
+
+func newStatusError(uri string, resp *http.Response) *statusError {
+	return &statusError{
+		uri:        RedactURL(uri),
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("failed to fetch %s : %s", e.uri, e.status)
+}
+
+// classify reports whether the error is transient, and the delay requested by the server if any.
+func classify(err error) (bool, time.Duration) {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return retryableStatus(statusErr.statusCode), statusErr.retryAfter
+	}
+	if errors.Is(err, context.Canceled) {
+		return false, 0
+	}
+	// url.Error is a net.Error itself, the underlying error decides
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	// the hosts not found are permanent, e.g. a typo in the host, while the temporary DNS failures are retried
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, 0
+	}
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &opErr),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED):
+		return true, 0
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true, 0
+	}
+	return false, 0
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests ||
+		(code >= http.StatusInternalServerError && code != http.StatusNotImplemented)
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// retryTransport retries the requests without body, e.g. the requests of registry clients.
+type retryTransport struct {
+	base    http.RoundTripper
+	retrier *retrier
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		return t.base.RoundTrip(req)
+	}
+	var resp *http.Response
+	err := t.retrier.do(req.Context(), func() error {
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		var err error
+		if resp, err = t.base.RoundTrip(req); err != nil {
+			return err
+		}
+		if retryableStatus(resp.StatusCode) {
+			return newStatusError(req.URL.String(), resp)
+		}
+		return nil
+	})
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		// the last response is returned to the client as is
+		return resp, nil
+	}
+	if err != nil && resp != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, err
+}
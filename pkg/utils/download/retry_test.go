@@ -0,0 +1,147 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testRetrier returns a retrier recording the delays instead of sleeping.
+func testRetrier(maxAttempts int, delays *[]time.Duration) *retrier {
+	r := newRetrier(&RetryOptions{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: &metav1.Duration{Duration: time.Second},
+		MaxBackoff:     &metav1.Duration{Duration: 4 * time.Second},
+	})
+	r.sleep = func(_ context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return nil
+	}
+	return r
+}
+
+func TestRetrierDo(t *testing.T) {
+	transient := &statusError{statusCode: http.StatusBadGateway}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{
+			name:     "succeeds after transient errors",
+			errs:     []error{transient, io.ErrUnexpectedEOF, nil},
+			attempts: 3,
+		},
+		{
+			name:     "permanent error",
+			errs:     []error{&statusError{statusCode: http.StatusNotFound}},
+			attempts: 1,
+			err:      &statusError{statusCode: http.StatusNotFound},
+		},
+		{
+			name:     "attempts exhausted",
+			errs:     []error{transient, transient, transient, transient, nil},
+			attempts: 4,
+			err:      transient,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delays []time.Duration
+			attempts := 0
+			err := testRetrier(4, &delays).do(context.Background(), func() error {
+				attempts++
+				return tt.errs[attempts-1]
+			})
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.attempts, attempts)
+			assert.Len(t, delays, attempts-1)
+		})
+	}
+}
+
+func TestRetrierRetryAfter(t *testing.T) {
+	var delays []time.Duration
+	errs := []error{
+		&statusError{statusCode: http.StatusTooManyRequests, retryAfter: 2 * time.Second},
+		&statusError{statusCode: http.StatusTooManyRequests, retryAfter: time.Minute},
+		nil,
+	}
+	attempts := 0
+	err := testRetrier(3, &delays).do(context.Background(), func() error {
+		attempts++
+		return errs[attempts-1]
+	})
+	assert.NoError(t, err)
+	// Retry-After is limited by the max backoff
+	assert.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second}, delays)
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	r := testRetrier(10, nil)
+	for attempt, backoff := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 4 * time.Second, 100: 4 * time.Second} {
+		for i := 0; i < 10; i++ {
+			delay := r.backoff(attempt)
+			assert.GreaterOrEqual(t, delay, backoff/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, delay, backoff, "attempt %d", attempt)
+		}
+	}
+}
+
+func TestRetrierContextCanceled(t *testing.T) {
+	r := newRetrier(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+	err := r.do(ctx, func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err        error
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{err: &statusError{statusCode: http.StatusServiceUnavailable}, retryable: true},
+		{err: &statusError{statusCode: http.StatusTooManyRequests, retryAfter: time.Second}, retryable: true, retryAfter: time.Second},
+		{err: &statusError{statusCode: http.StatusNotImplemented}},
+		{err: &statusError{statusCode: http.StatusUnauthorized}},
+		{err: &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, retryable: true},
+		{err: &url.Error{Op: "Get", Err: syscall.ECONNRESET}, retryable: true},
+		{err: &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "charts.invalid", IsNotFound: true}}}},
+		{err: &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "server misbehaving", Name: "charts.local", IsTemporary: true}}}, retryable: true},
+		{err: fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), retryable: true},
+		{err: &url.Error{Op: "Get", Err: errors.New("x509: certificate signed by unknown authority")}},
+		{err: context.Canceled},
+	}
+	for _, tt := range tests {
+		retryable, retryAfter := classify(tt.err)
+		assert.Equal(t, tt.retryable, retryable, tt.err.Error())
+		assert.Equal(t, tt.retryAfter, retryAfter, tt.err.Error())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("invalid"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+	delay := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, time.Minute, delay, float64(2*time.Second))
+}
@@ -0,0 +1,307 @@
+package download
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Keys of the Secret referred by S3DownloaderOptions.Secret.
+const (
+	SecretAccessKeyIDKey     = "accessKeyID"
+	SecretSecretAccessKeyKey = "secretAccessKey"
+	SecretSessionTokenKey    = "sessionToken"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	// emptyPayloadHash is the SHA-256 of the empty body of GET requests.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var s3DefaultSchemes = []string{"s3"}
+
+// S3DownloaderOptions configures the downloads of `s3://<bucket>/<key>` from S3 compatible object storages,
+// e.g. MinIO. The requests are anonymous without credentials.
+type S3DownloaderOptions struct {
+	// Endpoint is the URL of the object storage, e.g. `https://minio.local:9000`, defaults to AWS S3 of the region.
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Region   string `json:"region,omitempty" yaml:"region,omitempty"`
+	// PathStyle addresses the buckets by `<endpoint>/<bucket>` instead of `<bucket>.<endpoint host>`,
+	// which is required by most self-hosted object storages.
+	PathStyle       bool   `json:"pathStyle,omitempty" yaml:"pathStyle,omitempty"`
+	AccessKeyID     string `json:"accessKeyID,omitempty" yaml:"accessKeyID,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty" yaml:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty" yaml:"sessionToken,omitempty"`
+	// Secret refers to a Secret containing the keys `accessKeyID`, `secretAccessKey` and optionally `sessionToken`,
+	// which take precedence over the fields above. Its Key is ignored. The Secret is read on the first download.
+	Secret  *SecretReference `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Timeout int64            `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// CaBundle is a base64 encoded PEM bundle, CaFile is the path of a PEM bundle.
+	CaBundle           string        `json:"caBundle,omitempty" yaml:"caBundle,omitempty"`
+	CaFile             string        `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+	InsecureSkipVerify bool          `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+	Retry              *RetryOptions `json:"retry,omitempty" yaml:"retry,omitempty"`
+	// Proxy and Transport default to the ones of HttpDownloaderOptions for the ChartDownloader.
+	Proxy     *ProxyOptions     `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	Transport *TransportOptions `json:"transport,omitempty" yaml:"transport,omitempty"`
+}
+
+// S3Downloader is safe for concurrent use, the requests are signed by AWS Signature Version 4 and share the
+// retries and resumption of HttpDownloader.
+type S3Downloader struct {
+	endpoint  *url.URL
+	pathStyle bool
+	timeout   time.Duration
+	transport *http.Transport
+	retrier   *retrier
+	Schemes   []string
+
+	secret       *SecretReference
+	secretGetter SecretGetter
+	signer       sigV4Signer
+	mu           sync.Mutex
+	// client is created on the first download if the credentials are read from the Secret
+	client *http.Client
+}
+
+func NewS3Downloader(options *S3DownloaderOptions, secretGetter SecretGetter) (*S3Downloader, error) {
+	if options == nil {
+		options = &S3DownloaderOptions{}
+	}
+	region := options.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+	endpoint := options.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") || endpointURL.Host == "" {
+		return nil, errors.Errorf("invalid s3 endpoint %s", endpoint)
+	}
+
+	if options.Secret != nil && secretGetter == nil {
+		return nil, errors.New("secret requires access to secrets")
+	}
+	if options.Secret == nil && (options.AccessKeyID == "") != (options.SecretAccessKey == "") {
+		return nil, errors.New("accessKeyID and secretAccessKey must be specified together")
+	}
+
+	timeout := defaultHttpTimeout
+	if options.Timeout > 0 {
+		timeout = options.Timeout
+	}
+	transport, err := newTransport(options.Proxy, options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if transport.TLSClientConfig, err = newTLSConfig(options.CaBundle, options.CaFile, options.InsecureSkipVerify); err != nil {
+		return nil, err
+	}
+	s := &S3Downloader{
+		endpoint:     endpointURL,
+		pathStyle:    options.PathStyle,
+		timeout:      time.Second * time.Duration(timeout),
+		transport:    transport,
+		retrier:      newRetrier(options.Retry),
+		Schemes:      s3DefaultSchemes,
+		secret:       options.Secret,
+		secretGetter: secretGetter,
+		signer: sigV4Signer{
+			region:          region,
+			accessKeyID:     options.AccessKeyID,
+			secretAccessKey: options.SecretAccessKey,
+			sessionToken:    options.SessionToken,
+			now:             time.Now,
+		},
+	}
+	if options.Secret == nil {
+		s.client = s.newClient(s.signer)
+	}
+	return s, nil
+}
+
+// newClient returns the client signing the requests by the credentials of the signer, the requests are
+// anonymous without credentials.
+func (s *S3Downloader) newClient(signer sigV4Signer) *http.Client {
+	var roundTripper http.RoundTripper = s.transport
+	if signer.accessKeyID != "" {
+		roundTripper = &sigV4Transport{base: s.transport, signer: &signer}
+	}
+	return &http.Client{Transport: roundTripper, Timeout: s.timeout}
+}
+
+// httpClient returns the client of the downloads, the credentials of the Secret are read on the first
+// download instead of the construction, so that a missing Secret only fails the downloads of s3 charts.
+// Failed reads are retried by the next download.
+func (s *S3Downloader) httpClient(ctx context.Context) (*http.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	ref := s.secret
+	data, err := s.secretGetter(ctx, ref.Namespace, ref.Name)
+	if err != nil {
+		return nil, errors.Errorf("failed to get secret %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	if _, ok := data[SecretAccessKeyIDKey]; !ok {
+		return nil, errors.Errorf("key %s not found in secret %s/%s", SecretAccessKeyIDKey, ref.Namespace, ref.Name)
+	}
+	signer := s.signer
+	signer.accessKeyID = string(data[SecretAccessKeyIDKey])
+	signer.secretAccessKey = string(data[SecretSecretAccessKeyKey])
+	signer.sessionToken = string(data[SecretSessionTokenKey])
+	if (signer.accessKeyID == "") != (signer.secretAccessKey == "") {
+		return nil, errors.Errorf("accessKeyID and secretAccessKey of secret %s/%s must be specified together", ref.Namespace, ref.Name)
+	}
+	s.client = s.newClient(signer)
+	return s.client, nil
+}
+
+func (s *S3Downloader) Get(ctx context.Context, uri string, w io.Writer) error {
+	u, err := s.objectURL(uri)
+	if err != nil {
+		return err
+	}
+	client, err := s.httpClient(ctx)
+	if err != nil {
+		return err
+	}
+	f := &httpFetch{ctx: ctx, client: client, uri: u.String(), url: u, w: w}
+	return s.retrier.do(ctx, f.fetch)
+}
+
+// objectURL returns the HTTP URL of the object of `s3://<bucket>/<key>`.
+func (s *S3Downloader) objectURL(uri string) (*url.URL, error) {
+	_, ref, _ := strings.Cut(uri, "://")
+	bucket, key, _ := strings.Cut(ref, "/")
+	if bucket == "" || key == "" {
+		return nil, errors.Errorf("invalid s3 URI %s, expected s3://<bucket>/<key>", uri)
+	}
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/" + key
+	if s.pathStyle {
+		path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	// the path is sent as it is signed
+	u.Path, u.RawPath = path, s3Escape(path)
+	return &u, nil
+}
+
+func (s *S3Downloader) Provides(scheme string) bool {
+	for _, i := range s.Schemes {
+		if scheme == i {
+			return true
+		}
+	}
+	return false
+}
+
+// s3Escape escapes the path the same way as the canonical URI of S3, i.e. every byte except the unreserved
+// characters and slashes.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// sigV4Transport signs each request right before it is sent, so that retries and range requests are
+// signed with their own headers and time.
+type sigV4Transport struct {
+	base   http.RoundTripper
+	signer *sigV4Signer
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	t.signer.sign(req)
+	return t.base.RoundTrip(req)
+}
+
+// sigV4Signer signs the requests without body to S3 by AWS Signature Version 4.
+type sigV4Signer struct {
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	now             func() time.Time
+}
+
+func (s *sigV4Signer) sign(req *http.Request) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// the host, the range and the x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
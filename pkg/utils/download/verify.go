@@ -0,0 +1,160 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+// VerificationOptions configures the verification of chart archives, a chart failing the verification
+// fails its download.
+type VerificationOptions struct {
+	// Digests are the expected SHA-256 digests of chart archives by URI, e.g. `sha256:<hex>`.
+	Digests map[string]string `json:"digests,omitempty" yaml:"digests,omitempty"`
+	// Keyring is the path of a public keyring, once set the provenance file `<uri>.prov` of each chart
+	// is required and its signature is verified against the keyring.
+	Keyring string `json:"keyring,omitempty" yaml:"keyring,omitempty"`
+}
+
+// provenanceSuffix is the suffix of provenance files, OCIDownloader pulls the provenance layer for it.
+const provenanceSuffix = ".prov"
+
+// DownloadOption configures a single download of the ChartDownloader.
+type DownloadOption func(*downloadOptions)
+
+type downloadOptions struct {
+	digest string
+	hosts  map[string]HttpHostOptions
+}
+
+// WithDigest verifies the SHA-256 digest of the chart archive, it overrides VerificationOptions.Digests.
+func WithDigest(digest string) DownloadOption {
+	return func(o *downloadOptions) {
+		o.digest = digest
+	}
+}
+
+// VerificationError is returned when a downloaded chart fails its digest, provenance or cosign verification,
+// unlike the other download errors it means that the chart must not be trusted rather than it's unavailable.
+type VerificationError struct {
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// parseDigest returns the hex of the SHA-256 digest in the form of `sha256:<hex>` or `<hex>`.
+func parseDigest(digest string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok {
+		algorithm, encoded = "sha256", digest
+	}
+	if algorithm != "sha256" {
+		return "", errors.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+	if decoded, err := hex.DecodeString(encoded); err != nil || len(decoded) != sha256.Size {
+		return "", errors.Errorf("invalid sha256 digest %s", digest)
+	}
+	return strings.ToLower(encoded), nil
+}
+
+// VerifyDigest verifies that the data matches the SHA-256 digest.
+func VerifyDigest(data []byte, digest string) error {
+	expected, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return errors.Errorf("digest mismatch: expected sha256:%s, got sha256:%s", expected, actual)
+	}
+	return nil
+}
+
+// verifiedDownload downloads the chart to a temporary file, which is verified before it is written to w,
+// so that the content of an unverified chart is never used.
+func (c *ChartDownloader) verifiedDownload(ctx context.Context, downloader Downloader, uri string, w io.Writer, digest string) error {
+	dir, err := os.MkdirTemp("", "chart-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "chart.tgz")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := downloader.Get(ctx, uri, f); err != nil {
+		return err
+	}
+
+	if digest != "" {
+		expected, err := parseDigest(digest)
+		if err != nil {
+			return err
+		}
+		actual, err := provenance.DigestFile(path)
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return &VerificationError{Err: errors.Errorf("chart %s doesn't match the digest: expected sha256:%s, got sha256:%s", RedactURL(uri), expected, actual)}
+		}
+	}
+	if c.signatory != nil {
+		if err := c.verifyProvenance(ctx, downloader, uri, path); err != nil {
+			return &VerificationError{Err: errors.Errorf("failed to verify provenance of chart %s: %v", RedactURL(uri), err)}
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// verifyProvenance verifies the chart archive against its provenance file, which refers to the archive
+// by the file name `<name>-<version>.tgz`.
+func (c *ChartDownloader) verifyProvenance(ctx context.Context, downloader Downloader, uri, path string) error {
+	dir := filepath.Dir(path)
+	provPath := filepath.Join(dir, "chart.tgz"+provenanceSuffix)
+	prov, err := os.Create(provPath)
+	if err != nil {
+		return err
+	}
+	err = downloader.Get(ctx, uri+provenanceSuffix, prov)
+	if closeErr := prov.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download provenance: %w", err)
+	}
+
+	ch, err := loader.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	chartPath := filepath.Join(dir, fmt.Sprintf("%s-%s.tgz", ch.Metadata.Name, ch.Metadata.Version))
+	if err := os.Link(path, chartPath); err != nil {
+		return err
+	}
+	_, err = c.signatory.Verify(chartPath, provPath)
+	return err
+}
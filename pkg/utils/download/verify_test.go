@@ -0,0 +1,136 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp" //nolint
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+func TestVerifyDigest(t *testing.T) {
+	data := []byte("chart")
+	digest := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	assert.NoError(t, VerifyDigest(data, "sha256:"+digest))
+	assert.NoError(t, VerifyDigest(data, digest))
+	assert.ErrorContains(t, VerifyDigest([]byte("other"), digest), "digest mismatch")
+	assert.ErrorContains(t, VerifyDigest(data, "sha512:"+digest), "unsupported digest algorithm sha512")
+	assert.ErrorContains(t, VerifyDigest(data, "sha256:invalid"), "invalid sha256 digest")
+}
+
+func TestChartDownloaderVerifyDigest(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	path := filepath.Join(t.TempDir(), "devops-1.2.0.tgz")
+	require.NoError(t, os.WriteFile(path, archive, 0o644))
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(archive))
+	other := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		Verification: &VerificationOptions{Digests: map[string]string{path: digest}},
+	})
+	require.NoError(t, err)
+	buf, err := chartDownloader.Download(context.Background(), path)
+	require.NoError(t, err)
+	assert.Equal(t, archive, buf.Bytes())
+
+	// the chart isn't written once it doesn't match the digest
+	buf = bytes.NewBuffer(nil)
+	err = chartDownloader.DownloadTo(context.Background(), path, buf, WithDigest(other))
+	assert.ErrorContains(t, err, "doesn't match the digest")
+	assert.ErrorAs(t, err, new(*VerificationError))
+	assert.Zero(t, buf.Len())
+
+	_, err = NewChartDownloader(&Options{
+		Verification: &VerificationOptions{Digests: map[string]string{path: "md5:123"}},
+	})
+	assert.ErrorContains(t, err, "invalid digest of chart")
+}
+
+func TestChartDownloaderVerifyProvenance(t *testing.T) {
+	archive := testChartArchive(t, "devops", "1.2.0")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "devops-1.2.0.tgz")
+	require.NoError(t, os.WriteFile(path, archive, 0o644))
+
+	entity, err := openpgp.NewEntity("test", "", "test@kubesphere.io", nil)
+	require.NoError(t, err)
+	signer := &provenance.Signatory{Entity: entity, KeyRing: openpgp.EntityList{entity}}
+	prov, err := signer.ClearSign(path)
+	require.NoError(t, err)
+
+	keyring := filepath.Join(dir, "pubring.gpg")
+	f, err := os.Create(keyring)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(f))
+	require.NoError(t, f.Close())
+
+	files := map[string][]byte{
+		"/devops-1.2.0.tgz":        archive,
+		"/devops-1.2.0.tgz.prov":   []byte(prov),
+		"/tampered-1.2.0.tgz":      testChartArchive(t, "devops", "1.2.1"),
+		"/tampered-1.2.0.tgz.prov": []byte(prov),
+		"/unsigned-1.2.0.tgz":      archive,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	chartDownloader, err := NewChartDownloader(&Options{
+		HttpOptions:  &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+		Verification: &VerificationOptions{Keyring: keyring},
+	})
+	require.NoError(t, err)
+
+	buf, err := chartDownloader.Download(context.Background(), server.URL+"/devops-1.2.0.tgz")
+	require.NoError(t, err)
+	assert.Equal(t, archive, buf.Bytes())
+
+	_, err = chartDownloader.Download(context.Background(), server.URL+"/tampered-1.2.0.tgz")
+	assert.ErrorContains(t, err, "failed to verify provenance")
+	assert.ErrorAs(t, err, new(*VerificationError))
+	_, err = chartDownloader.Download(context.Background(), server.URL+"/unsigned-1.2.0.tgz")
+	assert.ErrorContains(t, err, "failed to download provenance")
+
+	// a mirror failing the verification is still reported as such once all mirrors failed
+	mirrored, err := NewChartDownloader(&Options{
+		HttpOptions:  &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+		Verification: &VerificationOptions{Keyring: keyring},
+		Mirrors:      []MirrorRule{{Prefix: "https://charts.kubesphere.io/", Mirrors: []string{server.URL + "/missing/", server.URL + "/"}}},
+	})
+	require.NoError(t, err)
+	_, err = mirrored.Download(context.Background(), "https://charts.kubesphere.io/tampered-1.2.0.tgz")
+	assert.ErrorContains(t, err, "from all mirrors")
+	assert.ErrorAs(t, err, new(*VerificationError))
+
+	// the charts cached without verification are not served to the downloads verified by the keyring
+	unverified, err := NewChartDownloader(&Options{Cache: &CacheOptions{}})
+	require.NoError(t, err)
+	_, err = unverified.Download(context.Background(), server.URL+"/unsigned-1.2.0.tgz")
+	require.NoError(t, err)
+	chartDownloader, err = NewChartDownloader(&Options{
+		HttpOptions:  &HttpDownloaderOptions{Retry: &RetryOptions{MaxAttempts: 1}},
+		Verification: &VerificationOptions{Keyring: keyring},
+	}, WithChartCache(unverified.Cache()))
+	require.NoError(t, err)
+	_, err = chartDownloader.Download(context.Background(), server.URL+"/unsigned-1.2.0.tgz")
+	assert.ErrorContains(t, err, "failed to download provenance")
+
+	_, err = NewChartDownloader(&Options{Verification: &VerificationOptions{Keyring: filepath.Join(dir, "missing.gpg")}})
+	assert.ErrorContains(t, err, "failed to load keyring")
+}